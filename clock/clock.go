@@ -0,0 +1,22 @@
+package clock
+
+import "time"
+
+// Clock abstracts the passage of time for retry backoff and rate limiting, so
+// that behavior can be driven deterministically instead of by real sleeping.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	Tick(d time.Duration) <-chan time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// Real is the wall clock
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) Tick(d time.Duration) <-chan time.Time  { return time.Tick(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
@@ -0,0 +1,79 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is a Clock for tests. Its time stands still until Advance is called,
+// except that Sleep and After move it forward by their duration at once, so
+// code that backs off finishes without real waiting while the time it would
+// have waited can still be read from Now. Tick channels fire as Advance passes
+// each period; like time.Ticker they drop ticks nobody was there to receive.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+type fakeTicker struct {
+	next   time.Time
+	period time.Duration
+	ch     chan time.Time
+}
+
+// NewFake returns a fake clock reading start
+func NewFake(start time.Time) *Fake {
+	return &Fake{now: start}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Sleep advances the clock by d and returns immediately
+func (f *Fake) Sleep(d time.Duration) {
+	f.Advance(d)
+}
+
+// After advances the clock by d and returns a channel that already holds the
+// new time
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.Advance(d)
+	ch := make(chan time.Time, 1)
+	ch <- f.Now()
+	return ch
+}
+
+// Tick returns a channel that receives the time once per period d of fake
+// time, or nil for a d that is not positive, like time.Tick
+func (f *Fake) Tick(d time.Duration) <-chan time.Time {
+	if d <= 0 {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTicker{next: f.now.Add(d), period: d, ch: make(chan time.Time, 1)}
+	f.tickers = append(f.tickers, t)
+	return t.ch
+}
+
+// Advance moves the clock forward by d, firing the tickers that came due
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if d > 0 {
+		f.now = f.now.Add(d)
+	}
+	for _, t := range f.tickers {
+		for !t.next.After(f.now) {
+			select {
+			case t.ch <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.period)
+		}
+	}
+}
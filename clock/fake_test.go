@@ -0,0 +1,60 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func TestFakeSleepAndAfterAdvance(t *testing.T) {
+	fake := NewFake(start)
+	fake.Sleep(2 * time.Second)
+	if got := fake.Now().Sub(start); got != 2*time.Second {
+		t.Fatalf("after Sleep(2s) the clock moved %v", got)
+	}
+
+	select {
+	case at := <-fake.After(500 * time.Millisecond):
+		if !at.Equal(start.Add(2500 * time.Millisecond)) {
+			t.Errorf("After delivered %v, want %v", at, start.Add(2500*time.Millisecond))
+		}
+	default:
+		t.Fatal("After channel was not ready")
+	}
+}
+
+func TestFakeTick(t *testing.T) {
+	fake := NewFake(start)
+	ticks := fake.Tick(200 * time.Millisecond)
+
+	fake.Advance(199 * time.Millisecond)
+	select {
+	case <-ticks:
+		t.Fatal("ticked before the period passed")
+	default:
+	}
+
+	fake.Advance(time.Millisecond)
+	select {
+	case at := <-ticks:
+		if !at.Equal(start.Add(200 * time.Millisecond)) {
+			t.Errorf("tick at %v, want %v", at, start.Add(200*time.Millisecond))
+		}
+	default:
+		t.Fatal("no tick after one period")
+	}
+
+	// Like time.Ticker, ticks nobody received are dropped, not queued
+	fake.Advance(time.Second)
+	<-ticks
+	select {
+	case <-ticks:
+		t.Fatal("missed ticks were queued")
+	default:
+	}
+
+	if fake.Tick(0) != nil {
+		t.Error("Tick(0) should return nil like time.Tick")
+	}
+}
@@ -2,376 +2,1160 @@ package complete
 
 import (
 	"bufio"
+	"bytes"
+	"complete_run/clock"
+	"complete_run/config"
+	"complete_run/errreport"
+	"complete_run/eta"
+	"complete_run/events"
+	"complete_run/mark"
+	"complete_run/qase"
+	"complete_run/redact"
+	"complete_run/retry"
+	"complete_run/runids"
+	"complete_run/setup"
+	"complete_run/stdio"
+	"complete_run/transport"
+	"complete_run/webhook"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"math"
-	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
-type APIResponse struct {
-	Status       bool   `json:"status"`
-	ErrorMessage string `json:"errorMessage"`
+// Run is a test run of the run list
+type Run = qase.Run
+
+// runFilter narrows the discovered in-progress runs to a start time window.
+// A zero bound is open. Runs skipped for their start time are logged to log.
+type runFilter struct {
+	startAfter  time.Time
+	startBefore time.Time
+	log         io.Writer
 }
 
-type RunsAPIResponse struct {
-	Status bool `json:"status"`
-	Result struct {
-		Total    int   `json:"total"`
-		Filtered int   `json:"filtered"`
-		Count    int   `json:"count"`
-		Entities []Run `json:"entities"`
-	} `json:"result"`
+func newRunFilter(cfg *config.Config, log io.Writer) runFilter {
+	return runFilter{startAfter: cfg.StartAfter, startBefore: cfg.StartBefore, log: log}
 }
 
-type Run struct {
-	ID     int `json:"id"`
-	Status int `json:"status"`
+// matches reports whether the run falls inside the window. Runs whose start
+// time is missing or unparseable are excluded whenever a bound is set.
+func (f runFilter) matches(run Run) bool {
+	if f.startAfter.IsZero() && f.startBefore.IsZero() {
+		return true
+	}
+
+	started, err := config.ParseTime(run.StartTime)
+	if err != nil {
+		fmt.Fprintf(f.log, "Skipping run %s: cannot determine start time (%q)\n", redact.ID(run.ID), run.StartTime)
+		return false
+	}
+	if !f.startAfter.IsZero() && !started.After(f.startAfter) {
+		return false
+	}
+	if !f.startBefore.IsZero() && !started.Before(f.startBefore) {
+		return false
+	}
+	return true
 }
 
-// RetryConfig holds configuration for retry mechanism
-type RetryConfig struct {
-	MaxRetries      int
-	InitialDelay    time.Duration
-	MaxDelay        time.Duration
-	BackoffFactor   float64
-	RequestTimeout  time.Duration
+// Use a more aggressive retry config for completion calls
+var completionRetryConfig = retry.Config{
+	MaxRetries:     2, // Fewer retries for completion to avoid duplicate operations
+	InitialDelay:   300 * time.Millisecond,
+	MaxDelay:       5 * time.Second,
+	BackoffFactor:  2.0,
+	RequestTimeout: 20 * time.Second,
 }
 
-// Default retry configuration
-var defaultRetryConfig = RetryConfig{
-	MaxRetries:      3,
-	InitialDelay:    500 * time.Millisecond,
-	MaxDelay:        10 * time.Second,
-	BackoffFactor:   2.0,
-	RequestTimeout:  30 * time.Second,
+// Clock used for backoff sleeps and rate limiting; swappable for deterministic timing
+var clk = clock.Real
+
+// Completer completes runs for one configuration through api, writing its log
+// lines to log. Every entry point starts a new error log and report, so a
+// Completer runs one of them at a time.
+type Completer struct {
+	cfg  *config.Config
+	api  *qase.Client
+	log  io.Writer
+	errs errreport.Logger
+
+	completionBody  []byte // Built from --completion-field; nil sends no body
+	completionRetry retry.Config
+
+	// Request rates and parallel completions, from --rps and --concurrency.
+	// The complete stage completes one run at a time.
+	rps        int
+	allRPS     int
+	allWorkers int
+
+	// Caps the number of lines written to the --errors-file; failures beyond
+	// it are only counted and summarized in a trailer line. Every failure is
+	// still kept in failures for --failed-file.
+	errorLogMutex  sync.Mutex
+	loggedErrors   int
+	unloggedErrors int
+	failures       []failedRun
+
+	// The --complete-report, filled from concurrent workers under reportMutex
+	reportMutex sync.Mutex
+	report      Report
+	reportStart time.Time
 }
 
-// Create HTTP client with timeout
-var httpClient = &http.Client{
-	Timeout: defaultRetryConfig.RequestTimeout,
+// New returns a Completer sending its requests through api. It applies the
+// process-wide settings of cfg with setup.Apply.
+func New(cfg *config.Config, api *qase.Client, log io.Writer) *Completer {
+	setup.Apply(cfg)
+	c := &Completer{
+		cfg:             cfg,
+		api:             api.WithLog(log),
+		log:             log,
+		errs:            errreport.To(log),
+		completionRetry: completionRetryConfig,
+		rps:             cfg.StageRPS(DefaultRPS),
+		allRPS:          cfg.StageRPS(DefaultAllRPS),
+		allWorkers:      cfg.StageConcurrency(defaultAllWorkers),
+	}
+	c.completionBody, _ = config.CompletionBody(cfg.CompletionFields) // Checked by Validate
+	c.completionRetry.MaxRetries = cfg.CompleteRetries
+	return c
 }
 
-// isRetryableError determines if an error should be retried
-func isRetryableError(err error, statusCode int) bool {
+// start checks the credentials every entry point needs and resets the error
+// log and report of an earlier call
+func (c *Completer) start() error {
+	if c.cfg.APIToken == "" || c.cfg.ProjectCode == "" {
+		return errors.New("missing API token or project code in environment variables")
+	}
+
+	c.errorLogMutex.Lock()
+	c.loggedErrors = 0
+	c.unloggedErrors = 0
+	c.failures = nil
+	c.errorLogMutex.Unlock()
+
+	c.resetReport()
+	return nil
+}
+
+// CompleteRuns completes the runs listed in the final file
+func (c *Completer) CompleteRuns(ctx context.Context) error {
+	cfg := c.cfg
+	if err := c.start(); err != nil {
+		return err
+	}
+	defer c.api.CloseIdle() // Release keep-alive sockets once the stage is done
+	defer c.writeCompleteReport()
+
+	if err := c.checkProjectStamp(cfg.FinalPath); err != nil {
+		if !cfg.Force {
+			return fmt.Errorf("refusing to complete runs: %v (use --force to override)", err)
+		}
+		c.errs.Warnf("complete", "", "%s %v; continuing because --force is set", mark.Warn, err)
+	}
+
+	ctx, cancel := cfg.StageContext(ctx, cfg.CompleteTimeout)
+	defer cancel()
+
+	runIDs, err := runids.Read(cfg.FinalPath, cfg.RunsFileFormat, c.log)
 	if err != nil {
-		// Network errors, timeouts, etc. are retryable
-		return true
+		return fmt.Errorf("reading file: %v", err)
 	}
-	
-	// HTTP status codes that are retryable
-	switch statusCode {
-	case 429: // Too Many Requests
-		return true
-	case 500, 502, 503, 504: // Server errors
-		return true
-	default:
-		return false
+	if len(runIDs) == 0 {
+		fmt.Fprintf(c.log, "%s lists no run IDs, nothing to complete\n", cfg.FinalPath)
+	}
+	state, runIDs, err := c.onlyNew(runIDs)
+	if err != nil {
+		return err
 	}
+	defer state.close()
+	return c.completeRunIDs(ctx, runIDs, state)
 }
 
-// calculateBackoffDelay calculates the delay for exponential backoff
-func calculateBackoffDelay(attempt int, config RetryConfig) time.Duration {
-	delay := time.Duration(float64(config.InitialDelay) * math.Pow(config.BackoffFactor, float64(attempt)))
-	if delay > config.MaxDelay {
-		delay = config.MaxDelay
+// CompleteRunsInMemory completes the given run IDs instead of reading
+// final.txt: those handed over by the match stage for --in-memory, or those
+// given by --run-ids
+func (c *Completer) CompleteRunsInMemory(ctx context.Context, runIDs []int) error {
+	cfg := c.cfg
+	if err := c.start(); err != nil {
+		return err
 	}
-	return delay
-}
+	defer c.api.CloseIdle() // Release keep-alive sockets once the stage is done
+	defer c.writeCompleteReport()
 
-// retryableHTTPRequest performs an HTTP request with retry logic
-func retryableHTTPRequest(req *http.Request, config RetryConfig) (*http.Response, error) {
-	var lastErr error
-	var resp *http.Response
-	
-	for attempt := 0; attempt <= config.MaxRetries; attempt++ {
-		// Use the HTTP client's timeout instead of context timeout to avoid conflicts
-		resp, lastErr = httpClient.Do(req)
-		
-		if lastErr == nil && resp != nil {
-			// Check if the status code indicates success or non-retryable error
-			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-				return resp, nil
-			}
-			
-			if !isRetryableError(nil, resp.StatusCode) {
-				return resp, fmt.Errorf("non-retryable HTTP error: %d", resp.StatusCode)
-			}
-			
-			// Close the response body for retryable errors
-			resp.Body.Close()
-		}
-		
-		// Don't sleep after the last attempt
-		if attempt < config.MaxRetries {
-			delay := calculateBackoffDelay(attempt, config)
-			fmt.Printf("Request failed (attempt %d/%d), retrying in %v...\n", 
-				attempt+1, config.MaxRetries+1, delay)
-			time.Sleep(delay)
-		}
+	ctx, cancel := cfg.StageContext(ctx, cfg.CompleteTimeout)
+	defer cancel()
+
+	state, runIDs, err := c.onlyNew(runIDs)
+	if err != nil {
+		return err
 	}
-	
-	return resp, fmt.Errorf("request failed after %d attempts: %v", config.MaxRetries+1, lastErr)
+	defer state.close()
+	return c.completeRunIDs(ctx, runIDs, state)
 }
 
-func CompleteRuns() {
-	apiToken := os.Getenv("QASE_API_TOKEN")
-	projectCode := os.Getenv("QASE_PROJECT_CODE")
-	if apiToken == "" || projectCode == "" {
-		fmt.Println("Missing API token or project code in environment variables")
-		return
+// onlyNew opens the --only-new state file and drops the run IDs an earlier
+// invocation already completed. Without --only-new it returns a nil state and
+// runIDs unchanged.
+func (c *Completer) onlyNew(runIDs []int) (state *checkpoint, pending []int, err error) {
+	cfg := c.cfg
+	if !cfg.OnlyNew {
+		return nil, runIDs, nil
+	}
+	state, err = openCheckpoint(cfg.StateFile, c.errs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening state file: %v", err)
 	}
+	pending = state.pending(runIDs)
+	if skipped := len(runIDs) - len(pending); skipped > 0 {
+		fmt.Fprintf(c.log, "Skipping %d runs already completed according to %s\n", skipped, cfg.StateFile)
+	}
+	return state, pending, nil
+}
 
-	runIDs := readRunIDs("final.txt")
-	rateLimiter := time.Tick(200 * time.Millisecond) // 5 requests per second
+// Default request rates of complete and complete-all, and of parallel
+// complete-all requests, unless --rps/--concurrency are set
+const (
+	DefaultRPS        = 5
+	DefaultAllRPS     = 4 // 4 requests per second to stay within 3-5 range
+	defaultAllWorkers = 5
+)
 
+// completeRunIDs completes runIDs one at a time at the complete stage's rate.
+// Successful completions are recorded in state, which may be nil. It returns an
+// error if any run failed to complete.
+func (c *Completer) completeRunIDs(ctx context.Context, runIDs []int, state *checkpoint) error {
+	rateLimiter := clk.Tick(time.Second / time.Duration(c.rps))
+	transport.UseLimits(c.rps, 1)
+	meter := eta.Start(c.log, "Completed", len(runIDs), c.cfg.ProgressInterval)
+
+	completed, failed := 0, 0
+launch:
 	for _, runID := range runIDs {
-		<-rateLimiter
-		if !completeRun(apiToken, projectCode, runID) {
-			logError(runID)
+		select {
+		case <-ctx.Done():
+			break launch
+		case <-rateLimiter:
+		}
+		// select picks at random when both are ready
+		if ctx.Err() != nil {
+			break launch
+		}
+		completed++
+		if c.cfg.DryRun {
+			fmt.Fprintf(c.log, "[DRY RUN] Would complete Run ID %s\n", redact.ID(runID))
+			c.recordOutcome(runID, nil)
+			meter.Add(1)
+			continue
+		}
+		err := c.completeRun(ctx, runID)
+		webhook.RunCompleted(c.log, runID, err == nil)
+		c.recordOutcome(runID, err)
+		meter.Add(1)
+		if err == nil {
+			state.record(runID)
+		} else {
+			failed++
+			c.logError(runID, err)
 		}
 	}
-}
+	meter.Stop()
+	webhook.Wait()
 
-func readRunIDs(filename string) []int {
-	content, err := os.ReadFile(filename)
-	if err != nil {
-		fmt.Println("Error reading file:", err)
+	if remaining := len(runIDs) - completed; remaining > 0 {
+		c.recordRemaining(remaining)
+		c.errs.Warnf("complete", "", "%s Complete %s, remaining: %d runs", mark.Time, config.StopReason(ctx), remaining)
+	}
+	if c.cfg.DryRun {
+		fmt.Fprintf(c.log, "[DRY RUN] %d runs would have been completed\n", completed)
 		return nil
 	}
-	parts := strings.Split(strings.TrimSpace(string(content)), ",")
-	var runIDs []int
-	for _, part := range parts {
-		var id int
-		fmt.Sscanf(part, "%d", &id)
-		runIDs = append(runIDs, id)
+	c.finishErrorLog()
+	c.writeFailedFile()
+	retry.ReportBudget(c.log, "complete")
+	return c.failedRuns(failed)
+}
+
+// ErrRunsFailed is wrapped by the error of a complete stage that went through
+// its runs but could not complete some of them, as opposed to one that could
+// not do its job at all
+var ErrRunsFailed = errors.New("runs failed to complete")
+
+// failedRuns turns the number of runs that failed to complete into the stage
+// error, nil if none did
+func (c *Completer) failedRuns(failed int) error {
+	if failed == 0 {
+		return nil
 	}
-	return runIDs
+	return fmt.Errorf("%d %w; see %s", failed, ErrRunsFailed, c.cfg.ErrorsPath)
 }
 
-func completeRun(apiToken, projectCode string, runID int) bool {
-	url := fmt.Sprintf("https://api.qase.io/v1/run/%s/%d/complete", projectCode, runID)
-	req, err := http.NewRequest("POST", url, nil)
+// checkProjectStamp verifies that filename was produced for the configured
+// project. Files without a stamp (e.g. written by another tool) are accepted
+// with a warning.
+func (c *Completer) checkProjectStamp(filename string) error {
+	projectCode := c.cfg.ProjectCode
+	meta, err := runids.ReadMeta(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintf(c.log, "%s %s has no project stamp; cannot verify it belongs to project %s\n", mark.Warn, filename, projectCode)
+		return nil
+	}
 	if err != nil {
-		fmt.Printf("Error creating request for run %d: %v\n", runID, err)
-		return false
+		return err
+	}
+	if meta.ProjectCode != projectCode {
+		return fmt.Errorf("%s was generated for project %s but the configured project is %s",
+			filename, meta.ProjectCode, projectCode)
 	}
-	req.Header.Add("accept", "application/json")
-	req.Header.Add("Token", apiToken)
+	return nil
+}
+
+// completeRun marks one run as complete, without retrying once ctx is done. A
+// failure is returned as a *completionError.
+func (c *Completer) completeRun(ctx context.Context, runID int) (err error) {
+	outcome := events.Completion{RunID: runID}
+	defer func() {
+		outcome.Success = err == nil
+		if eventErr := events.Completed(outcome); eventErr != nil {
+			fmt.Fprintf(c.log, "Error recording event for run %s: %v\n", redact.ID(runID), eventErr)
+		}
+	}()
 
-	// Use a more aggressive retry config for completion calls
-	completionRetryConfig := RetryConfig{
-		MaxRetries:      2, // Fewer retries for completion to avoid duplicate operations
-		InitialDelay:    300 * time.Millisecond,
-		MaxDelay:        5 * time.Second,
-		BackoffFactor:   2.0,
-		RequestTimeout:  20 * time.Second,
+	if c.cfg.SkipCompleted {
+		prefix := "[run=" + redact.ID(runID) + "] "
+		status, err := c.fetchRunStatus(ctx, runID)
+		switch {
+		case err != nil:
+			fmt.Fprintf(c.log, "%sCould not look up run %s (%v), completing it anyway\n", prefix, redact.ID(runID), err)
+		case status != config.RunStatuses["active"]:
+			outcome.RunStatus = &status
+			fmt.Fprintf(c.log, "%sRun ID %s is no longer in progress (%s), skipping %s\n", prefix, redact.ID(runID), describeStatus(status), mark.OK)
+			return nil
+		}
 	}
 
-	res, err := retryableHTTPRequest(req, completionRetryConfig)
+	prefix := "[run=" + redact.ID(runID) + "] "
+	completion, err := c.api.CompleteRun(ctx, c.cfg.ProjectCode, runID, qase.CompletionRequest{
+		Path:  c.cfg.CompletePath,
+		Body:  c.completionBody,
+		Retry: c.completionRetry,
+	})
+	outcome.Attempts = completion.Attempts
+	outcome.HTTPStatus = completion.HTTPStatus
 	if err != nil {
-		fmt.Printf("API request failed for run %d after retries: %v ❌\n", runID, err)
-		return false
+		c.errs.Errorf("complete", "run="+redact.ID(runID), "%sFailed to complete run %s: %v %s", prefix, redact.ID(runID), err, mark.Fail)
+		return &completionError{HTTPStatus: outcome.HTTPStatus, Reason: err.Error()}
 	}
-	defer res.Body.Close()
+	body := completion.Body
 
-	body, err := io.ReadAll(res.Body)
+	success, reason := completionSucceeded(body, c.cfg.StrictCompleteStatus)
+	if !success {
+		c.errs.Errorf("complete", "run="+redact.ID(runID), "%sFailed to mark Run ID %s as complete (%s) %s", prefix, redact.ID(runID), reason, mark.Fail)
+		return &completionError{HTTPStatus: outcome.HTTPStatus, Reason: reason}
+	}
+
+	fmt.Fprintf(c.log, "%sSuccessfully marked Run ID %s as complete %s\n", prefix, redact.ID(runID), mark.OK)
+	if reason != "" {
+		fmt.Fprintf(c.log, "%s  Note: %s\n", prefix, reason)
+	}
+	if state, ok := returnedRunState(body); ok {
+		outcome.RunStatus = state.Status
+		outcome.EndTime = state.EndTime
+		if state.Status != nil && *state.Status != config.RunStatuses["complete"] {
+			fmt.Fprintf(c.log, "%s  Note: server reports run status %d after completion\n", prefix, *state.Status)
+		}
+	}
+	return nil
+}
+
+// fetchRunStatus looks up the current status of a run, for --skip-completed
+func (c *Completer) fetchRunStatus(ctx context.Context, runID int) (int, error) {
+	run, err := c.api.GetRun(ctx, c.cfg.ProjectCode, runID, false)
 	if err != nil {
-		fmt.Printf("Error reading response for run %d: %v ❌\n", runID, err)
-		return false
+		return 0, err
 	}
+	return run.Status, nil
+}
 
-	var apiResp APIResponse
-	if err := json.Unmarshal(body, &apiResp); err != nil {
-		fmt.Printf("Error parsing JSON response for run %d: %v ❌\n", runID, err)
-		return false
+// describeStatus names a run status code for log lines
+func describeStatus(status int) string {
+	for name, code := range config.RunStatuses {
+		if code == status {
+			return name
+		}
 	}
+	return fmt.Sprintf("status %d", status)
+}
+
+// completionError is a failed completion, with the HTTP status of the last
+// response if one was received
+type completionError struct {
+	HTTPStatus int
+	Reason     string
+}
+
+func (e *completionError) Error() string {
+	return e.Reason
+}
+
+// runState is the updated run some servers return from a completion, as
+// {"status": true, "result": {"status": 1, "end_time": "..."}}
+type runState struct {
+	Status  *int   `json:"status"`
+	EndTime string `json:"end_time"`
+}
 
-	if apiResp.Status {
-		fmt.Printf("Successfully marked Run ID %d as complete ✅\n", runID)
-	} else {
-		fmt.Printf("Failed to mark Run ID %d as complete (API returned false) ❌\n", runID)
-		if apiResp.ErrorMessage != "" {
-			fmt.Printf("  Error message: %s\n", apiResp.ErrorMessage)
+// returnedRunState extracts the run returned by a completion. ok is false for
+// responses without one, such as a bare {"status": true}.
+func returnedRunState(body []byte) (state runState, ok bool) {
+	var apiResp struct {
+		Result *runState `json:"result"`
+	}
+	if json.Unmarshal(body, &apiResp) != nil || apiResp.Result == nil {
+		return state, false
+	}
+	state = *apiResp.Result
+	return state, state.Status != nil || state.EndTime != ""
+}
+
+// completionSucceeded decides whether a 2xx completion response means the run
+// was completed. Only an explicit "status": false is a failure, unless strict
+// (--strict-complete-status) requires an explicit "status": true. reason
+// explains a failure, or a success that was assumed despite an unexpected body.
+func completionSucceeded(body []byte, strict bool) (success bool, reason string) {
+	var apiResp struct {
+		Status       *bool  `json:"status"`
+		ErrorMessage string `json:"errorMessage"`
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		if strict {
+			return false, "empty response body"
 		}
+		return true, "empty response body, assuming success from the 2xx status"
+	}
+	if err := json.Unmarshal(body, &apiResp); err != nil {
+		if strict {
+			return false, fmt.Sprintf("error parsing JSON response: %v", err)
+		}
+		return true, fmt.Sprintf("unparseable response body (%v), assuming success from the 2xx status", err)
 	}
 
-	return apiResp.Status
+	switch {
+	case apiResp.Status == nil && strict:
+		return false, "response has no status field"
+	case apiResp.Status == nil:
+		return true, "response has no status field, assuming success from the 2xx status"
+	case !*apiResp.Status && apiResp.ErrorMessage != "":
+		return false, "API returned false: " + apiResp.ErrorMessage
+	case !*apiResp.Status:
+		return false, "API returned false"
+	}
+	return true, ""
 }
 
-func logError(runID int) {
-	file, err := os.OpenFile("errors.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// logError records a failed completion. It is called from concurrent workers;
+// errorLogMutex serializes the --errors-file appends and the failures list.
+func (c *Completer) logError(runID int, err error) {
+	c.errorLogMutex.Lock()
+	defer c.errorLogMutex.Unlock()
+
+	c.failures = append(c.failures, newFailedRun(runID, err))
+
+	if c.cfg.MaxLoggedErrors > 0 && c.loggedErrors >= c.cfg.MaxLoggedErrors {
+		c.unloggedErrors++
+		return
+	}
+	c.loggedErrors++
+
+	c.appendToErrorLog(fmt.Sprintf("Run ID %d: %v\n", runID, err))
+}
+
+// finishErrorLog writes the "... and N more" trailer when errors were capped
+func (c *Completer) finishErrorLog() {
+	c.errorLogMutex.Lock()
+	defer c.errorLogMutex.Unlock()
+
+	if c.unloggedErrors > 0 {
+		c.appendToErrorLog(fmt.Sprintf("... and %d more\n", c.unloggedErrors))
+	}
+}
+
+func (c *Completer) appendToErrorLog(line string) {
+	file, err := stdio.Append(c.cfg.ErrorsPath)
 	if err != nil {
-		fmt.Println("Error opening error log file:", err)
+		c.errs.Errorf("complete", "", "Error opening error log file: %v", err)
 		return
 	}
 	defer file.Close()
 
 	logger := bufio.NewWriter(file)
-	logger.WriteString(fmt.Sprintf("Run ID %d: Test run not found\n", runID))
+	logger.WriteString(line)
 	logger.Flush()
 }
 
-// CompleteAllInProgressRuns fetches all in-progress test runs and marks them as complete
-func CompleteAllInProgressRuns() {
-	apiToken := os.Getenv("QASE_API_TOKEN")
-	projectCode := os.Getenv("QASE_PROJECT_CODE")
-	if apiToken == "" || projectCode == "" {
-		fmt.Println("Missing API token or project code in environment variables")
+// checkpoint records successfully completed run IDs, one per line, so a sweep
+// that dies halfway can resume without re-completing runs. A nil checkpoint
+// records nothing.
+type checkpoint struct {
+	mu   sync.Mutex
+	file *os.File
+	done map[int]bool
+	errs errreport.Logger
+}
+
+// openCheckpoint loads the run IDs already recorded in path and opens it for
+// appending. Failed writes are reported through errs.
+func openCheckpoint(path string, errs errreport.Logger) (*checkpoint, error) {
+	done := make(map[int]bool)
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		// A torn last line from a crash is ignored; that run is simply retried
+		if id, err := strconv.Atoi(line); err == nil {
+			done[id] = true
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &checkpoint{file: file, done: done, errs: errs}, nil
+}
+
+// completed reports whether runID was recorded by an earlier sweep
+func (c *checkpoint) completed(runID int) bool {
+	return c != nil && c.done[runID]
+}
+
+// pending returns the run IDs not yet recorded, keeping their order
+func (c *checkpoint) pending(runIDs []int) []int {
+	if c == nil {
+		return runIDs
+	}
+	var remaining []int
+	for _, id := range runIDs {
+		if !c.done[id] {
+			remaining = append(remaining, id)
+		}
+	}
+	return remaining
+}
+
+func (c *checkpoint) record(runID int) {
+	if c == nil {
 		return
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := fmt.Fprintf(c.file, "%d\n", runID); err != nil {
+		c.errs.Errorf("complete", "", "Error writing checkpoint: %v", err)
+	}
+}
+
+func (c *checkpoint) close() {
+	if c != nil {
+		c.file.Close()
+	}
+}
+
+// CompleteAllInProgressRuns fetches all in-progress test runs and marks them as complete
+func (c *Completer) CompleteAllInProgressRuns(ctx context.Context) error {
+	cfg := c.cfg
+	if err := c.start(); err != nil {
+		return err
+	}
+	defer c.api.CloseIdle() // Release keep-alive sockets once the stage is done
+	defer c.writeCompleteReport()
+
+	// The time budget covers the whole sweep, discovery included
+	ctx, cancel := cfg.StageContext(ctx, cfg.CompleteTimeout)
+	defer cancel()
+	if cfg.MaxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.MaxDuration)
+		defer cancel()
+	}
+
+	var progress *checkpoint
+	if cfg.CheckpointFile != "" {
+		var err error
+		progress, err = openCheckpoint(cfg.CheckpointFile, c.errs)
+		if err != nil {
+			return fmt.Errorf("opening checkpoint file: %v", err)
+		}
+		defer progress.close()
+	}
+
+	if cfg.StreamSweep {
+		return c.streamSweep(ctx, newRunFilter(cfg, c.log), progress)
+	}
+
+	fmt.Fprintln(c.log, "Fetching all in-progress test runs...")
+	listed, listErr := c.fetchAllInProgressRuns(ctx, newRunFilter(cfg, c.log))
+	if listErr != nil {
+		// The listed runs are still in progress and worth completing, but the
+		// stage fails so the sweep is not taken for a complete one
+		listErr = fmt.Errorf("listing in-progress runs: %w", listErr)
+		fmt.Fprintf(c.log, "%s %v; completing the %d runs that were listed\n", mark.Warn, listErr, len(listed))
+	}
+	inProgressRuns := orderRuns(listed, cfg.SweepOrder)
 
-	fmt.Println("Fetching all in-progress test runs...")
-	inProgressRuns := fetchAllInProgressRuns(apiToken, projectCode)
-	
 	if len(inProgressRuns) == 0 {
-		fmt.Println("No in-progress test runs found.")
-		return
+		fmt.Fprintln(c.log, "No in-progress test runs found.")
+		return listErr
+	}
+
+	if progress != nil {
+		pending := progress.pending(inProgressRuns)
+		if skipped := len(inProgressRuns) - len(pending); skipped > 0 {
+			fmt.Fprintf(c.log, "Skipping %d runs already completed according to %s\n", skipped, cfg.CheckpointFile)
+		}
+		inProgressRuns = pending
+		if len(inProgressRuns) == 0 {
+			fmt.Fprintln(c.log, "All in-progress test runs are already in the checkpoint.")
+			return listErr
+		}
 	}
 
-	fmt.Printf("Found %d in-progress test runs. Starting completion process...\n", len(inProgressRuns))
-	
+	fmt.Fprintf(c.log, "Found %d in-progress test runs. Starting completion process...\n", len(inProgressRuns))
+
 	// Complete runs with rate limiting (3-5 calls per second)
-	completeRunsInParallel(apiToken, projectCode, inProgressRuns)
+	launched, failed := c.completeRunsInParallel(ctx, sendRunIDs(ctx, inProgressRuns), len(inProgressRuns), progress)
+	if remaining := len(inProgressRuns) - launched; remaining > 0 {
+		c.recordRemaining(remaining)
+		c.errs.Warnf("complete", "", "%s %s, remaining: %d runs", mark.Time, sweepStopped(ctx), remaining)
+	}
+	retry.ReportBudget(c.log, "complete")
+	if listErr != nil {
+		return listErr
+	}
+	return c.failedRuns(failed)
 }
 
-// fetchAllInProgressRuns fetches all test runs and filters for in-progress ones
-func fetchAllInProgressRuns(apiToken, projectCode string) []int {
-	const limit = 100
-	var allInProgressRuns []int
-	offset := 0
-	consecutiveFailures := 0
-	maxConsecutiveFailures := 3
+// streamSweep completes runs while they are still being discovered, so
+// completion starts with the first page and the run list is never held in
+// memory. Runs are completed in listing order; --sweep-order does not apply.
+func (c *Completer) streamSweep(ctx context.Context, filter runFilter, progress *checkpoint) error {
+	fmt.Fprintln(c.log, "Streaming in-progress test runs into completion...")
 
-	fmt.Println("Starting to fetch test runs with robust retry mechanism...")
+	// A small buffer lets discovery fetch the next page while completions run
+	runIDs := make(chan int, 100)
+	var discovered, skipped int
+	var listedAll bool
+	var listErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(runIDs)
+		listedAll, listErr = c.discoverInProgressRuns(ctx, filter, func(run Run) bool {
+			if progress.completed(run.ID) {
+				skipped++
+				return true
+			}
+			select {
+			case runIDs <- run.ID:
+				discovered++
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
 
-	for {
-		url := fmt.Sprintf("https://api.qase.io/v1/run/%s?limit=%d&offset=%d", projectCode, limit, offset)
-		req, err := http.NewRequest("GET", url, nil)
+	launched, failed := c.completeRunsInParallel(ctx, runIDs, 0, progress)
+	<-done
+
+	if skipped > 0 {
+		fmt.Fprintf(c.log, "Skipped %d runs already completed according to the checkpoint\n", skipped)
+	}
+	remaining := discovered - launched
+	c.recordRemaining(remaining)
+	if !listedAll {
+		c.errs.Warnf("complete", "", "%s %s, remaining: at least %d runs (discovery stopped early)", mark.Time, sweepStopped(ctx), remaining)
+	} else if remaining > 0 {
+		c.errs.Warnf("complete", "", "%s %s, remaining: %d runs", mark.Time, sweepStopped(ctx), remaining)
+	}
+	retry.ReportBudget(c.log, "complete")
+	if listErr != nil {
+		return fmt.Errorf("listing in-progress runs: %w", listErr)
+	}
+	return c.failedRuns(failed)
+}
+
+// sweepStopped says why a sweep left runs uncompleted
+func sweepStopped(ctx context.Context) string {
+	if config.StopReason(ctx) == "interrupted" {
+		return "Interrupted"
+	}
+	return "Time budget reached"
+}
+
+// Sweep orderings selectable via --sweep-order
+const (
+	orderOldest = "oldest"
+	orderNewest = "newest"
+	orderID     = "id"
+)
+
+// orderRuns sorts the discovered runs so capped sweeps are predictable and
+// returns their IDs
+func orderRuns(runs []Run, order string) []int {
+	sortRuns(runs, order)
+
+	runIDs := make([]int, len(runs))
+	for i, run := range runs {
+		runIDs[i] = run.ID
+	}
+	return runIDs
+}
+
+// sortRuns sorts runs in place. Age orderings use the start time; runs without
+// a parseable start time come last. Ties and the id ordering use the run ID.
+func sortRuns(runs []Run, order string) {
+	starts := make(map[int]time.Time, len(runs))
+	for _, run := range runs {
+		if started, err := config.ParseTime(run.StartTime); err == nil {
+			starts[run.ID] = started
+		}
+	}
+
+	sort.Slice(runs, func(i, j int) bool {
+		a, b := runs[i], runs[j]
+		if order != orderID {
+			startA, okA := starts[a.ID]
+			startB, okB := starts[b.ID]
+			switch {
+			case okA && !okB:
+				return true
+			case !okA && okB:
+				return false
+			case okA && okB && !startA.Equal(startB):
+				if order == orderNewest {
+					return startA.After(startB)
+				}
+				return startA.Before(startB)
+			}
+		}
+		return a.ID < b.ID
+	})
+}
+
+// listedRun is one entry of the --list-in-progress output
+type listedRun struct {
+	ID         int    `json:"id"`
+	Status     int    `json:"status"`
+	StartTime  string `json:"start_time,omitempty"`
+	AgeSeconds int64  `json:"age_seconds,omitempty"`
+}
+
+// ListInProgressRuns discovers in-progress runs exactly like
+// CompleteAllInProgressRuns but only writes them as JSON, completing nothing
+func (c *Completer) ListInProgressRuns(ctx context.Context) error {
+	cfg := c.cfg
+	if err := c.start(); err != nil {
+		return err
+	}
+	defer c.api.CloseIdle() // Release keep-alive sockets once the stage is done
+
+	fmt.Fprintln(c.log, "Fetching all in-progress test runs...")
+	runs, err := c.fetchAllInProgressRuns(ctx, newRunFilter(cfg, c.log))
+	if err != nil {
+		// A partial list would pass for everything --complete-all would complete
+		return fmt.Errorf("listing in-progress runs: %w", err)
+	}
+	sortRuns(runs, cfg.SweepOrder)
+
+	listed := listRuns(runs, clk.Now())
+	data, err := json.MarshalIndent(listed, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding in-progress runs: %v", err)
+	}
+	data = append(data, '\n')
+
+	if err := stdio.WriteFile(cfg.ListOutput, data); err != nil {
+		return fmt.Errorf("writing in-progress runs: %v", err)
+	}
+	fmt.Fprintf(c.log, "Wrote %d in-progress runs to %s\n", len(listed), cfg.ListOutput)
+	return nil
+}
+
+// listRuns turns runs into --list-in-progress entries, with their age at now
+// when their start time can be parsed
+func listRuns(runs []Run, now time.Time) []listedRun {
+	listed := make([]listedRun, len(runs))
+	for i, run := range runs {
+		listed[i] = listedRun{ID: run.ID, Status: run.Status, StartTime: run.StartTime}
+		if started, err := config.ParseTime(run.StartTime); err == nil {
+			listed[i].AgeSeconds = int64(now.Sub(started).Seconds())
+		}
+	}
+	return listed
+}
+
+// CountRuns returns the total number of runs in the project, in progress or
+// not, with a single request
+func (c *Completer) CountRuns() (int, error) {
+	list, err := c.api.ListRuns(context.Background(), c.cfg.ProjectCode, qase.RunQuery{Limit: 1})
+	if err != nil {
+		return 0, err
+	}
+	return list.Total, nil
+}
+
+// Page size and failure tolerance of the run listing
+const (
+	RunPageSize            = 100
+	maxConsecutiveFailures = 3
+)
+
+// fetchAllInProgressRuns fetches all test runs and filters for in-progress
+// ones. The first page tells how many runs there are; the remaining pages are
+// then fetched concurrently, at the parallelism and rate of complete-all. Runs are returned sorted by ID. If the first page fails
+// or has no total, it falls back to paging serially. When pages could not be
+// fetched the runs that were listed are returned with an error.
+func (c *Completer) fetchAllInProgressRuns(ctx context.Context, filter runFilter) ([]Run, error) {
+	fmt.Fprintln(c.log, "Starting to fetch test runs with robust retry mechanism...")
+
+	first, err := c.fetchRunPage(ctx, 0)
+	if err != nil || (first.Total == 0 && len(first.Entities) == RunPageSize) {
 		if err != nil {
-			fmt.Printf("Error creating request: %v\n", err)
-			consecutiveFailures++
-			if consecutiveFailures >= maxConsecutiveFailures {
-				fmt.Printf("Too many consecutive failures (%d), stopping fetch process\n", consecutiveFailures)
-				break
+			c.errs.Errorf("complete", "offset=0", "Failed to fetch runs at offset 0 after retries: %v; paging serially", err)
+		}
+		var allInProgressRuns []Run
+		_, err := c.discoverInProgressRuns(ctx, filter, func(run Run) bool {
+			allInProgressRuns = append(allInProgressRuns, run)
+			return true
+		})
+		sort.Slice(allInProgressRuns, func(i, j int) bool { return allInProgressRuns[i].ID < allInProgressRuns[j].ID })
+		return allInProgressRuns, err
+	}
+	total := first.Total
+	fmt.Fprintf(c.log, "%s Fetched %d runs (offset: 0) of %d\n", mark.OK, len(first.Entities), total)
+	listed := first.Entities
+
+	pages := (total + RunPageSize - 1) / RunPageSize
+	meter := eta.Start(c.log, "Fetched run pages", pages, c.cfg.ProgressInterval)
+	meter.Add(1)
+
+	// A string of failures stops the remaining pages. Workers finish their
+	// pages in no particular order, so outcomes are counted in page order: a
+	// page's outcome is held back until every page before it has finished.
+	pageCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failedPages := 0
+	stopped := false
+	outcomes := make(map[int]bool) // Page number to failed, for finished pages not yet counted
+	nextPage := 1
+	consecutiveFailures := 0
+	offsets := make(chan int)
+	for i := 0; i < c.allWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for offset := range offsets {
+				page, err := c.fetchRunPage(pageCtx, offset)
+
+				mu.Lock()
+				if err != nil {
+					c.errs.Errorf("complete", fmt.Sprintf("offset=%d", offset), "Failed to fetch runs at offset %d: %v", offset, err)
+					failedPages++
+				} else {
+					listed = append(listed, page.Entities...)
+					fmt.Fprintf(c.log, "%s Fetched %d runs (offset: %d)\n", mark.OK, len(page.Entities), offset)
+				}
+				outcomes[offset/RunPageSize] = err != nil
+				for {
+					failed, done := outcomes[nextPage]
+					if !done {
+						break
+					}
+					delete(outcomes, nextPage)
+					nextPage++
+					if !failed {
+						consecutiveFailures = 0
+						continue
+					}
+					consecutiveFailures++
+					if consecutiveFailures == maxConsecutiveFailures && !stopped {
+						c.errs.Errorf("complete", fmt.Sprintf("offset=%d", (nextPage-1)*RunPageSize), "Too many consecutive failures (%d), stopping fetch process", consecutiveFailures)
+						stopped = true
+						cancel()
+					}
+				}
+				mu.Unlock()
+				meter.Add(1)
 			}
+		}()
+	}
+
+	rateLimiter := clk.Tick(time.Second / time.Duration(c.allRPS))
+	transport.UseLimits(c.allRPS, c.allWorkers)
+send:
+	for offset := RunPageSize; offset < total; offset += RunPageSize {
+		select {
+		case <-pageCtx.Done():
+			break send
+		case <-rateLimiter:
+		}
+		select {
+		case <-pageCtx.Done():
+			break send
+		case offsets <- offset:
+		}
+	}
+	close(offsets)
+	wg.Wait()
+	meter.Stop()
+	if ctx.Err() != nil {
+		fmt.Fprintln(c.log, "Stopped fetching test runs early")
+	}
+	var listErr error
+	switch {
+	case stopped:
+		listErr = fmt.Errorf("listing stopped after %d failed pages in a row; the run list is incomplete", maxConsecutiveFailures)
+	case failedPages > 0:
+		listErr = fmt.Errorf("%d pages of runs could not be fetched; the run list is incomplete", failedPages)
+	}
+
+	// Pages can overlap if runs shift while paging
+	seen := make(map[int]bool)
+	duplicates := 0
+	var allInProgressRuns []Run
+	for _, run := range listed {
+		if run.Status != config.RunStatuses["active"] || !filter.matches(run) {
 			continue
 		}
-		req.Header.Add("accept", "application/json")
-		req.Header.Add("Token", apiToken)
+		if seen[run.ID] {
+			duplicates++
+			continue
+		}
+		seen[run.ID] = true
+		allInProgressRuns = append(allInProgressRuns, run)
+	}
+	sort.Slice(allInProgressRuns, func(i, j int) bool { return allInProgressRuns[i].ID < allInProgressRuns[j].ID })
 
-		fmt.Printf("Fetching runs at offset %d...\n", offset)
-		resp, err := retryableHTTPRequest(req, defaultRetryConfig)
+	if duplicates > 0 {
+		fmt.Fprintf(c.log, "%s Skipped %d duplicate runs; the listing changed during pagination\n", mark.Warn, duplicates)
+	}
+	fmt.Fprintf(c.log, "Fetch complete. Found %d in-progress runs total\n", len(allInProgressRuns))
+	return allInProgressRuns, listErr
+}
+
+// fetchRunPage fetches one page of the run list, with retries
+func (c *Completer) fetchRunPage(ctx context.Context, offset int) (*qase.RunList, error) {
+	return c.api.ListRuns(ctx, c.cfg.ProjectCode, qase.RunQuery{Limit: RunPageSize, Offset: offset})
+}
+
+// discoverInProgressRuns pages through all test runs and passes each
+// in-progress one that matches filter to emit as soon as its page arrives.
+// It stops early when emit returns false or ctx is done and returns whether it
+// reached the last page. Pages that could not be fetched are skipped and
+// reported in the error, as is a string of failures that stopped the listing.
+func (c *Completer) discoverInProgressRuns(ctx context.Context, filter runFilter, emit func(Run) bool) (listedAll bool, err error) {
+	found := 0
+	seen := make(map[int]bool) // Pages can overlap if runs shift while paging
+	duplicates := 0
+	offset := 0
+	consecutiveFailures := 0
+	failedPages := 0
+
+	for {
+		if ctx.Err() != nil {
+			fmt.Fprintln(c.log, "Stopped fetching test runs early")
+			return false, nil
+		}
+
+		fmt.Fprintf(c.log, "Fetching runs at offset %d...\n", offset)
+		apiResp, err := c.fetchRunPage(ctx, offset)
 		if err != nil {
-			fmt.Printf("Failed to fetch runs at offset %d after retries: %v\n", offset, err)
+			c.errs.Errorf("complete", fmt.Sprintf("offset=%d", offset), "Failed to fetch runs at offset %d: %v", offset, err)
+			failedPages++
 			consecutiveFailures++
 			if consecutiveFailures >= maxConsecutiveFailures {
-				fmt.Printf("Too many consecutive failures (%d), stopping fetch process\n", consecutiveFailures)
-				break
+				c.errs.Errorf("complete", fmt.Sprintf("offset=%d", offset), "Too many consecutive failures (%d), stopping fetch process", consecutiveFailures)
+				return false, fmt.Errorf("listing stopped after %d failed pages in a row; the run list is incomplete", consecutiveFailures)
 			}
 			// Skip this batch and try the next one
-			offset += limit
+			offset += RunPageSize
 			continue
 		}
-		defer resp.Body.Close()
 
 		// Reset consecutive failures on successful request
 		consecutiveFailures = 0
 
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Printf("Error reading response: %v\n", err)
-			offset += limit
-			continue
-		}
-
-		var apiResp RunsAPIResponse
-		if err := json.Unmarshal(body, &apiResp); err != nil {
-			fmt.Printf("Error parsing JSON: %v\n", err)
-			offset += limit
-			continue
-		}
-
-		if !apiResp.Status {
-			fmt.Printf("API response status is false at offset %d, skipping batch\n", offset)
-			offset += limit
-			continue
-		}
-
-		// Filter for in-progress runs (status = 0)
+		// Filter for in-progress runs
 		batchInProgressCount := 0
-		for _, run := range apiResp.Result.Entities {
-			if run.Status == 0 { // 0 = in-progress
-				allInProgressRuns = append(allInProgressRuns, run.ID)
+		for _, run := range apiResp.Entities {
+			if run.Status == config.RunStatuses["active"] && filter.matches(run) {
+				if seen[run.ID] {
+					duplicates++
+					fmt.Fprintf(c.log, "Run %s listed again at offset %d; the run list shifted while paging\n", redact.ID(run.ID), offset)
+					continue
+				}
+				seen[run.ID] = true
+				found++
 				batchInProgressCount++
+				if !emit(run) {
+					fmt.Fprintln(c.log, "Stopped fetching test runs early")
+					return false, nil
+				}
 			}
 		}
 
-		fmt.Printf("✅ Fetched %d runs (offset: %d), found %d in-progress in this batch, %d total so far\n", 
-			len(apiResp.Result.Entities), offset, batchInProgressCount, len(allInProgressRuns))
+		fmt.Fprintf(c.log, "%s Fetched %d runs (offset: %d), found %d in-progress in this batch, %d total so far\n", mark.OK,
+			len(apiResp.Entities), offset, batchInProgressCount, found)
 
 		// Check if we've fetched all runs
-		if len(apiResp.Result.Entities) < limit {
-			fmt.Println("Reached end of test runs")
+		if len(apiResp.Entities) < RunPageSize {
+			fmt.Fprintln(c.log, "Reached end of test runs")
 			break
 		}
 
-		offset += limit
-		
+		offset += RunPageSize
+
 		// Small delay to be respectful to the API
-		time.Sleep(200 * time.Millisecond)
+		clk.Sleep(200 * time.Millisecond)
 	}
 
-	fmt.Printf("Fetch complete. Found %d in-progress runs total\n", len(allInProgressRuns))
-	return allInProgressRuns
+	if duplicates > 0 {
+		fmt.Fprintf(c.log, "%s Skipped %d duplicate runs; the listing changed during pagination\n", mark.Warn, duplicates)
+	}
+	fmt.Fprintf(c.log, "Fetch complete. Found %d in-progress runs total\n", found)
+	if failedPages > 0 {
+		return true, fmt.Errorf("%d pages of runs could not be fetched; the run list is incomplete", failedPages)
+	}
+	return true, nil
 }
 
-// completeRunsInParallel completes runs with rate limiting (3-5 calls per second)
-func completeRunsInParallel(apiToken, projectCode string, runIDs []int) {
-	const maxConcurrent = 5
-	const requestsPerSecond = 4 // 4 requests per second to stay within 3-5 range
-	
-	semaphore := make(chan struct{}, maxConcurrent)
-	rateLimiter := time.Tick(time.Second / requestsPerSecond)
-	
+// completeRunsInParallel completes the runs received on runIDs until it is
+// closed, with rate limiting (3-5 calls per second). Once ctx is done no new
+// completions are started and in-flight ones finish. It prints the summary and
+// returns how many completions were started and how many of them failed.
+// Completed runs are recorded in progress, which may be nil.
+func (c *Completer) completeRunsInParallel(ctx context.Context, runIDs <-chan int, total int, progress *checkpoint) (launched, failed int) {
+	semaphore := make(chan struct{}, c.allWorkers)
+	rateLimiter := clk.Tick(time.Second / time.Duration(c.allRPS))
+	transport.UseLimits(c.allRPS, c.allWorkers)
+	meter := eta.Start(c.log, "Completed", total, c.cfg.ProgressInterval)
+
 	var wg sync.WaitGroup
 	var successCount, errorCount int
 	var mu sync.Mutex
 
-	for _, runID := range runIDs {
+launch:
+	for {
+		var runID int
+		select {
+		case <-ctx.Done():
+			break launch
+		case id, ok := <-runIDs:
+			if !ok {
+				break launch
+			}
+			runID = id
+		}
+
+		// Rate limiting
+		select {
+		case <-ctx.Done():
+			break launch
+		case <-rateLimiter:
+		}
+
+		select {
+		case <-ctx.Done():
+			break launch
+		case semaphore <- struct{}{}: // Acquire semaphore
+		}
+		// select picks at random when both are ready
+		if ctx.Err() != nil {
+			<-semaphore
+			break launch
+		}
+
+		launched++
 		wg.Add(1)
-		
+
 		go func(id int) {
 			defer wg.Done()
-			
-			// Rate limiting
-			<-rateLimiter
-			semaphore <- struct{}{} // Acquire semaphore
 			defer func() { <-semaphore }() // Release semaphore
-			
-			success := completeRun(apiToken, projectCode, id)
-			
+
+			if c.cfg.DryRun {
+				fmt.Fprintf(c.log, "[DRY RUN] Would complete Run ID %s\n", redact.ID(id))
+				c.recordOutcome(id, nil)
+				meter.Add(1)
+				mu.Lock()
+				successCount++
+				mu.Unlock()
+				return
+			}
+			err := c.completeRun(ctx, id)
+			webhook.RunCompleted(c.log, id, err == nil)
+			c.recordOutcome(id, err)
+			meter.Add(1)
+
 			mu.Lock()
-			if success {
+			if err == nil {
 				successCount++
+				progress.record(id)
 			} else {
 				errorCount++
-				logError(id)
+				c.logError(id, err)
 			}
 			mu.Unlock()
 		}(runID)
 	}
 
 	wg.Wait()
-	
-	fmt.Printf("\nCompletion Summary:\n")
-	fmt.Printf("✅ Successfully completed: %d runs\n", successCount)
-	fmt.Printf("❌ Failed to complete: %d runs\n", errorCount)
+	meter.Stop()
+	webhook.Wait()
+
+	if c.cfg.DryRun {
+		fmt.Fprintf(c.log, "\n[DRY RUN] %d runs would have been completed\n", successCount)
+		return launched, 0
+	}
+	fmt.Fprintf(c.log, "\nCompletion Summary:\n")
+	fmt.Fprintf(c.log, "%s Successfully completed: %d runs\n", mark.OK, successCount)
+	fmt.Fprintf(c.log, "%s Failed to complete: %d runs\n", mark.Fail, errorCount)
 	if errorCount > 0 {
-		fmt.Printf("Check errors.txt for details on failed runs\n")
+		c.finishErrorLog()
+		fmt.Fprintf(c.log, "Check %s for details on failed runs\n", c.cfg.ErrorsPath)
 	}
+	c.writeFailedFile()
+	return launched, errorCount
+}
+
+// sendRunIDs feeds runIDs to a channel for completeRunsInParallel, stopping
+// when ctx is done
+func sendRunIDs(ctx context.Context, runIDs []int) <-chan int {
+	ch := make(chan int)
+	go func() {
+		defer close(ch)
+		for _, id := range runIDs {
+			select {
+			case ch <- id:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
 }
@@ -0,0 +1,223 @@
+package complete
+
+import (
+	"complete_run/clock"
+	"complete_run/config"
+	"complete_run/qase"
+	"complete_run/retry"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCompleter returns a Completer for handler, sending requests without
+// pacing and retrying without waiting
+func testCompleter(t *testing.T, handler http.HandlerFunc) *Completer {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	cfg, err := config.Defaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.APIToken, cfg.ProjectCode = "token", "DEMO"
+	cfg.RPS = 1000
+	cfg.ErrorsPath = ""
+
+	c := New(cfg, qase.New(srv.URL, "token", srv.Client()), io.Discard)
+	reads := retry.Reads
+	retry.Reads.InitialDelay, retry.Reads.MaxDelay = time.Millisecond, time.Millisecond
+	t.Cleanup(func() { retry.Reads = reads })
+	return c
+}
+
+// runListServer lists the in-progress runs pages[offset/RunPageSize] for each
+// page and answers every completion. The listing reports total when it is set,
+// and fails the pages in failing. Completions are counted in completed.
+func runListServer(pages [][]int, total int, failing map[int]bool, completed *atomic.Int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			completed.Add(1)
+			io.WriteString(w, `{"status":true}`)
+			return
+		}
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		n := offset / RunPageSize
+		if failing[n] {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var runs []qase.Run
+		if n < len(pages) {
+			for _, id := range pages[n] {
+				runs = append(runs, qase.Run{ID: id})
+			}
+		}
+		result := map[string]interface{}{"entities": runs}
+		if total > 0 {
+			result["total"] = total
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": true, "result": result})
+	}
+}
+
+// idRange returns the IDs from first to last
+func idRange(first, last int) []int {
+	var ids []int
+	for id := first; id <= last; id++ {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestListRunsAge(t *testing.T) {
+	fake := clock.NewFake(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	defer func(c clock.Clock) { clk = c }(clk)
+	clk = fake
+	fake.Advance(90 * time.Minute)
+
+	runs := []Run{
+		{ID: 1, StartTime: "2024-03-01 12:00:00"},
+		{ID: 2, StartTime: "2024-03-01T13:00:00Z"},
+		{ID: 3, StartTime: "not a time"},
+		{ID: 4},
+	}
+	listed := listRuns(runs, clk.Now())
+	want := []int64{5400, 1800, 0, 0}
+	for i, run := range listed {
+		if run.ID != runs[i].ID || run.AgeSeconds != want[i] {
+			t.Errorf("run %d: age %d, want %d", run.ID, run.AgeSeconds, want[i])
+		}
+	}
+}
+
+func TestFetchAllInProgressRunsDeduplicatesOverlappingPages(t *testing.T) {
+	// Each page repeats the last run of the one before, as when runs shift
+	// while paging
+	pages := [][]int{idRange(1, 100), idRange(100, 199), idRange(199, 210)}
+	for _, total := range []int{212, 0} { // Concurrent pages after the first, or serial ones
+		var completed atomic.Int32
+		c := testCompleter(t, runListServer(pages, total, nil, &completed))
+
+		runs, err := c.fetchAllInProgressRuns(context.Background(), newRunFilter(c.cfg, io.Discard))
+		if err != nil {
+			t.Fatalf("total %d: fetchAllInProgressRuns failed: %v", total, err)
+		}
+		if len(runs) != 210 {
+			t.Fatalf("total %d: listed %d runs, want 210", total, len(runs))
+		}
+		for i, run := range runs {
+			if run.ID != i+1 {
+				t.Fatalf("total %d: run %d listed as %d, want each once in ID order", total, i, run.ID)
+			}
+		}
+	}
+}
+
+func TestCompleteAllReportsListingFailures(t *testing.T) {
+	var completed atomic.Int32
+	pages := [][]int{idRange(1, 100), idRange(101, 200), idRange(201, 250)}
+	c := testCompleter(t, runListServer(pages, 250, map[int]bool{1: true}, &completed))
+
+	err := c.CompleteAllInProgressRuns(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "1 pages of runs could not be fetched") {
+		t.Errorf("err = %v, want the failed page reported", err)
+	}
+	// The runs that were listed are still completed
+	if completed.Load() != 150 {
+		t.Errorf("%d runs completed, want the 150 listed", completed.Load())
+	}
+}
+
+func TestCompleteAllStopsAfterConsecutiveFailedPages(t *testing.T) {
+	tests := []struct {
+		name    string
+		failing map[int]bool
+		want    string
+	}{
+		// With 5 workers each of the pages 3 to 5 goes to a different worker
+		{"failures in a row across workers", map[int]bool{3: true, 4: true, 5: true}, "listing stopped after 3 failed pages in a row"},
+		{"failures apart", map[int]bool{3: true, 5: true, 7: true}, "3 pages of runs could not be fetched"},
+	}
+	for _, test := range tests {
+		var pages [][]int
+		for n := 0; n < 10; n++ {
+			pages = append(pages, idRange(n*RunPageSize+1, (n+1)*RunPageSize))
+		}
+		var completed atomic.Int32
+		c := testCompleter(t, runListServer(pages, 10*RunPageSize, test.failing, &completed))
+		c.allWorkers = 5
+
+		_, err := c.fetchAllInProgressRuns(context.Background(), newRunFilter(c.cfg, io.Discard))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: err = %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestCompletionSucceeded(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		strict bool
+		want   bool
+	}{
+		{"explicit true", `{"status":true}`, false, true},
+		{"explicit true, strict", `{"status":true}`, true, true},
+		{"explicit false", `{"status":false}`, false, false},
+		{"explicit false with a message", `{"status":false,"errorMessage":"Run is already completed"}`, false, false},
+		{"explicit false, strict", `{"status":false}`, true, false},
+		{"empty body", ``, false, true},
+		{"whitespace body", " \n", false, true},
+		{"empty body, strict", ``, true, false},
+		{"no status field", `{"result":{}}`, false, true},
+		{"no status field, strict", `{"result":{}}`, true, false},
+		{"not JSON", `OK`, false, true},
+		{"not JSON, strict", `OK`, true, false},
+	}
+	for _, test := range tests {
+		success, reason := completionSucceeded([]byte(test.body), test.strict)
+		if success != test.want {
+			t.Errorf("%s: success %v (%s), want %v", test.name, success, reason, test.want)
+		}
+		// Anything but an explicit true is explained
+		if (reason == "") != (test.body == `{"status":true}`) {
+			t.Errorf("%s: reason %q", test.name, reason)
+		}
+	}
+}
+
+func TestCompleteRunsJudgesTheResponseBody(t *testing.T) {
+	tests := []struct {
+		body      string
+		strict    bool
+		succeeded int
+	}{
+		{``, false, 1},
+		{``, true, 0},
+		{`{"status":false,"errorMessage":"Run not found"}`, false, 0},
+		{`{"status":true}`, true, 1},
+	}
+	for _, test := range tests {
+		c := testCompleter(t, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, test.body) // Always 200
+		})
+		c.cfg.StrictCompleteStatus = test.strict
+
+		err := c.CompleteRunsInMemory(context.Background(), []int{7})
+		if report := c.Report(); report.Succeeded != test.succeeded || report.Failed != 1-test.succeeded {
+			t.Errorf("body %q, strict %v: %d succeeded and %d failed, want %d succeeded", test.body, test.strict, report.Succeeded, report.Failed, test.succeeded)
+		}
+		if (err == nil) != (test.succeeded == 1) {
+			t.Errorf("body %q, strict %v: err = %v", test.body, test.strict, err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package complete_test
+
+import (
+	"complete_run/complete"
+	"complete_run/config"
+	"complete_run/qase"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// A Completer sends its completions through the client it is given, so it can
+// be pointed at an httptest.Server standing in for the Qase API
+func ExampleCompleter_CompleteRunsInMemory() {
+	var mu sync.Mutex
+	var completed []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		completed = append(completed, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		io.WriteString(w, `{"status":true}`)
+	}))
+	defer srv.Close()
+
+	cfg, _ := config.Defaults()
+	cfg.APIToken, cfg.ProjectCode = "token", "DEMO"
+	c := complete.New(cfg, qase.New(srv.URL, "token", srv.Client()), io.Discard)
+
+	if err := c.CompleteRunsInMemory(context.Background(), []int{7, 8}); err != nil {
+		fmt.Println(err)
+		return
+	}
+	// Runs are completed one at a time, in the order given
+	for _, request := range completed {
+		fmt.Println(request)
+	}
+	report := c.Report()
+	fmt.Println(report.Succeeded, "completed")
+	// Output:
+	// POST /run/DEMO/7/complete
+	// POST /run/DEMO/8/complete
+	// 2 completed
+}
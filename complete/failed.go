@@ -0,0 +1,113 @@
+package complete
+
+import (
+	"complete_run/redact"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// failedRun is one entry of the --failed-file JSON array
+type failedRun struct {
+	RunID      int       `json:"run_id"`
+	HTTPStatus int       `json:"http_status,omitempty"` // Status of the last response; absent if none was received
+	Error      string    `json:"error"`
+	Time       time.Time `json:"time"`
+}
+
+func newFailedRun(runID int, err error) failedRun {
+	failure := failedRun{RunID: runID, Error: err.Error(), Time: clk.Now().UTC()}
+	var completionErr *completionError
+	if errors.As(err, &completionErr) {
+		failure.HTTPStatus = completionErr.HTTPStatus
+	}
+	return failure
+}
+
+// writeFailedFile writes every failure logged so far to the --failed-file,
+// if one is set. The file is rewritten even when nothing failed, so a retry
+// never picks up a stale list.
+func (c *Completer) writeFailedFile() {
+	failedFile := c.cfg.FailedFile
+	if failedFile == "" {
+		return
+	}
+
+	c.errorLogMutex.Lock()
+	defer c.errorLogMutex.Unlock()
+
+	entries := c.failures
+	if entries == nil {
+		entries = []failedRun{}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		c.errs.Errorf("complete", "", "Error encoding failed runs: %v", err)
+		return
+	}
+	if err := os.WriteFile(failedFile, append(data, '\n'), 0644); err != nil {
+		c.errs.Errorf("complete", "", "Error writing failed runs: %v", err)
+		return
+	}
+	if len(entries) > 0 {
+		fmt.Fprintf(c.log, "Wrote %d failed runs to %s; retry them with --retry-failed %s\n", len(entries), failedFile, failedFile)
+	}
+}
+
+// readFailedFile returns the run IDs of a --failed-file output, each once, in
+// file order
+func readFailedFile(path string) ([]int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []failedRun
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	seen := make(map[int]bool, len(entries))
+	var runIDs []int
+	for _, entry := range entries {
+		if entry.RunID == 0 || seen[entry.RunID] {
+			continue
+		}
+		seen[entry.RunID] = true
+		runIDs = append(runIDs, entry.RunID)
+	}
+	return runIDs, nil
+}
+
+// CompleteFailedRuns completes the runs listed in the --retry-failed file, with
+// the same retries and rate limit as the complete stage. With --failed-file
+// pointing at the same file, it is rewritten with the runs that still fail.
+func (c *Completer) CompleteFailedRuns(ctx context.Context) error {
+	cfg := c.cfg
+	if err := c.start(); err != nil {
+		return err
+	}
+	defer c.api.CloseIdle() // Release keep-alive sockets once the stage is done
+	defer c.writeCompleteReport()
+
+	runIDs, err := readFailedFile(cfg.RetryFailed)
+	if err != nil {
+		return fmt.Errorf("reading failed runs: %v", err)
+	}
+	fmt.Fprintf(c.log, "Retrying %d failed runs from %s: %s\n", len(runIDs), cfg.RetryFailed, redact.IDs(runIDs))
+	if len(runIDs) == 0 {
+		return nil
+	}
+
+	ctx, cancel := cfg.StageContext(ctx, cfg.CompleteTimeout)
+	defer cancel()
+
+	state, runIDs, err := c.onlyNew(runIDs)
+	if err != nil {
+		return err
+	}
+	defer state.close()
+	return c.completeRunIDs(ctx, runIDs, state)
+}
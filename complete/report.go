@@ -0,0 +1,116 @@
+package complete
+
+import (
+	"complete_run/stdio"
+	"encoding/json"
+	"sort"
+)
+
+// Per-run statuses of the --complete-report
+const (
+	statusCompleted = "completed"
+	statusFailed    = "failed"
+	statusDryRun    = "dry_run"
+)
+
+// RunOutcome is the status of one completion attempt in the --complete-report
+type RunOutcome struct {
+	RunID  int    `json:"run_id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Report summarizes a complete stage, whichever mode ran it, so
+// dashboards can trend completion success rates
+type Report struct {
+	Attempted       int          `json:"attempted"`
+	Succeeded       int          `json:"succeeded"`
+	Failed          int          `json:"failed"`
+	Remaining       int          `json:"remaining"` // Runs not attempted because the stage was interrupted or ran out of time
+	DryRun          bool         `json:"dry_run,omitempty"`
+	DurationSeconds float64      `json:"duration_seconds"`
+	Runs            []RunOutcome `json:"runs"`
+}
+
+// resetReport starts a new report, for start
+func (c *Completer) resetReport() {
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+
+	c.report = Report{DryRun: c.cfg.DryRun}
+	c.reportStart = clk.Now()
+}
+
+// recordOutcome adds one completion attempt to the report; err is nil on
+// success
+func (c *Completer) recordOutcome(runID int, err error) {
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+
+	report := &c.report
+	outcome := RunOutcome{RunID: runID, Status: statusCompleted}
+	switch {
+	case c.cfg.DryRun:
+		outcome.Status = statusDryRun
+		report.Succeeded++
+	case err != nil:
+		outcome.Status = statusFailed
+		outcome.Error = err.Error()
+		report.Failed++
+	default:
+		report.Succeeded++
+	}
+	report.Attempted++
+	report.Runs = append(report.Runs, outcome)
+}
+
+// recordRemaining notes how many runs were left when the stage stopped early
+func (c *Completer) recordRemaining(remaining int) {
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+
+	c.report.Remaining = remaining
+}
+
+// Report returns the summary of the last complete stage, the one
+// --complete-report writes, or nil if none ran
+func (c *Completer) Report() *Report {
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+
+	if c.reportStart.IsZero() {
+		return nil
+	}
+	report := c.report
+	return &report
+}
+
+// writeCompleteReport finishes the report and writes it to the
+// --complete-report file, or stdout for "-". It is deferred by every complete
+// entry point, so it is written even when runs failed or the stage returned
+// early.
+func (c *Completer) writeCompleteReport() {
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+
+	report := &c.report
+	report.DurationSeconds = clk.Now().Sub(c.reportStart).Seconds()
+	if report.Runs == nil {
+		report.Runs = []RunOutcome{}
+	}
+	sort.Slice(report.Runs, func(i, j int) bool { return report.Runs[i].RunID < report.Runs[j].RunID })
+
+	path := c.cfg.CompleteReport
+	if path == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		c.errs.Errorf("complete", "", "Error encoding complete report: %v", err)
+		return
+	}
+	if err := stdio.WriteFile(path, append(data, '\n')); err != nil {
+		c.errs.Errorf("complete", "", "Error writing complete report: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package complete
+
+import (
+	"complete_run/qase"
+	"complete_run/redact"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CompleteRunRefs completes the runs named by --by-title and --by-key. Each
+// reference is resolved to a numeric run ID through the API first; references
+// that do not resolve to exactly one run are logged and skipped, and fail the
+// stage once the others are done.
+func (c *Completer) CompleteRunRefs(ctx context.Context) error {
+	cfg := c.cfg
+	if err := c.start(); err != nil {
+		return err
+	}
+	defer c.api.CloseIdle() // Release keep-alive sockets once the stage is done
+	defer c.writeCompleteReport()
+
+	var runIDs []int
+	unresolved := 0
+	for _, title := range cfg.ByTitle {
+		id, err := c.resolveTitle(ctx, title)
+		if err != nil {
+			c.errs.Errorf("complete", "", "Cannot resolve title %q: %v", title, err)
+			unresolved++
+			continue
+		}
+		fmt.Fprintf(c.log, "Resolved title %q to run %s\n", title, redact.ID(id))
+		runIDs = append(runIDs, id)
+	}
+	for _, key := range cfg.ByKey {
+		id, err := c.resolveKey(ctx, key)
+		if err != nil {
+			c.errs.Errorf("complete", "", "Cannot resolve key %q: %v", key, err)
+			unresolved++
+			continue
+		}
+		fmt.Fprintf(c.log, "Resolved key %q to run %s\n", key, redact.ID(id))
+		runIDs = append(runIDs, id)
+	}
+	if unresolved > 0 {
+		fmt.Fprintf(c.log, "%d run references could not be resolved and are skipped\n", unresolved)
+	}
+	var unresolvedErr error
+	if unresolved > 0 {
+		unresolvedErr = fmt.Errorf("%d run references could not be resolved", unresolved)
+	}
+	if len(runIDs) == 0 {
+		fmt.Fprintln(c.log, "No runs to complete.")
+		return unresolvedErr
+	}
+
+	ctx, cancel := cfg.StageContext(ctx, cfg.CompleteTimeout)
+	defer cancel()
+
+	state, runIDs, err := c.onlyNew(runIDs)
+	if err != nil {
+		return err
+	}
+	defer state.close()
+	if err := c.completeRunIDs(ctx, runIDs, state); err != nil {
+		return err
+	}
+	return unresolvedErr
+}
+
+// resolveTitle finds the run whose title is exactly title. The API search is
+// a substring match, so results are narrowed to exact matches; a title shared
+// by several runs is ambiguous and not resolved.
+func (c *Completer) resolveTitle(ctx context.Context, title string) (int, error) {
+	const limit = 100
+	var matches []int
+	for offset := 0; ; offset += limit {
+		list, err := c.api.ListRuns(ctx, c.cfg.ProjectCode, qase.RunQuery{Search: title, Limit: limit, Offset: offset})
+		if err != nil {
+			return 0, err
+		}
+
+		for _, run := range list.Entities {
+			if run.Title == title {
+				matches = append(matches, run.ID)
+			}
+		}
+		if len(list.Entities) < limit {
+			break
+		}
+		clk.Sleep(200 * time.Millisecond)
+	}
+
+	switch len(matches) {
+	case 0:
+		return 0, errors.New("no run has this title")
+	case 1:
+		return matches[0], nil
+	default:
+		return 0, fmt.Errorf("%d runs share this title (%s); use --by-key instead", len(matches), redact.IDs(matches))
+	}
+}
+
+// resolveKey turns a run key such as DEMO-42, the project code and run number
+// shown in the Qase UI, into a run ID after checking the run exists
+func (c *Completer) resolveKey(ctx context.Context, key string) (int, error) {
+	projectCode := c.cfg.ProjectCode
+	i := strings.LastIndex(key, "-")
+	if i <= 0 {
+		return 0, errors.New("expected <project-code>-<run-number>, e.g. DEMO-42")
+	}
+	id, err := strconv.Atoi(key[i+1:])
+	if err != nil || id <= 0 {
+		return 0, errors.New("expected <project-code>-<run-number>, e.g. DEMO-42")
+	}
+	if !strings.EqualFold(key[:i], projectCode) {
+		return 0, fmt.Errorf("belongs to project %s, not %s", key[:i], projectCode)
+	}
+
+	if _, err := c.api.GetRun(ctx, projectCode, id, false); err != nil {
+		if errors.Is(err, qase.ErrNotFound) {
+			return 0, errors.New("no such run")
+		}
+		return 0, err
+	}
+	return id, nil
+}
@@ -0,0 +1,971 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Config holds every recognized configuration option. Each field is tagged with
+// the environment variable and/or command-line flag it is read from, its default
+// and a one-line description, so loading and --help-config stay in sync. A flag
+// that only applies to some commands lists them in its cmd tag; a flag without
+// one applies to every command.
+//
+// Precedence is default < environment variable < flag.
+type Config struct {
+	APIToken    string `env:"QASE_API_TOKEN" desc:"Authentication token for the Qase API"`
+	TokenFile   string `env:"QASE_API_TOKEN_FILE" desc:"File holding the API token; takes precedence over QASE_API_TOKEN"`
+	ProjectCode string `env:"QASE_PROJECT_CODE" desc:"Project code identifying the test runs"`
+	APIBaseURL  string `env:"QASE_API_BASE_URL" desc:"Base URL of a self-hosted Qase API, version included, e.g. https://qase.example.com/v1 (default https://api.qase.io/<api-version>)"`
+	CompleteAll bool   `flag:"complete-all" cmd:"pipeline,complete-all" default:"false" desc:"Mark all in-progress test runs as complete"`
+	HelpConfig  bool   `flag:"help-config" default:"false" desc:"List every configuration option and exit"`
+	Redact      bool   `flag:"redact" default:"false" desc:"Replace run and case IDs in log output with stable per-invocation hashes"`
+	PrintCurl   bool   `flag:"print-curl" cmd:"pipeline,fetch,match,complete,complete-all" default:"false" desc:"Print an equivalent curl command for each kind of API request"`
+	Verbose     bool   `flag:"verbose" default:"false" desc:"Print debug output: raw API responses, file contents and full run ID lists"`
+
+	Command string `default:"pipeline" desc:"What to run, given as the first argument before any flags: pipeline, fetch, filter, match, complete or complete-all"`
+
+	NoColor bool `flag:"no-color" default:"false" desc:"Print OK/FAIL/WARN/TIME instead of emoji markers (automatic when output is not a terminal)"`
+	Events  bool `flag:"events" cmd:"pipeline,complete,complete-all" default:"false" desc:"Write one JSON line per completion attempt to stdout; log lines go to stderr"`
+
+	ErrorReport string `flag:"error-report" default:"error_report.json" desc:"Write every error and warning of all stages as JSON to this file at exit (- for stdout, empty to skip)"`
+
+	RetryBudget     int           `flag:"retry-budget" cmd:"pipeline,fetch,match,complete,complete-all" default:"0" desc:"Max total retries across the whole invocation (0 = unlimited)"`
+	RetryBudgetTime time.Duration `flag:"retry-budget-time" cmd:"pipeline,fetch,match,complete,complete-all" default:"0" desc:"Max total backoff time across the whole invocation (0 = unlimited)"`
+	ReadRetries     int           `flag:"read-retries" cmd:"pipeline,fetch,match,complete,complete-all" default:"3" desc:"Max retries per idempotent GET request"`
+	CompleteRetries int           `flag:"complete-retries" cmd:"pipeline,complete,complete-all" default:"2" desc:"Max retries per completion request (kept low to avoid duplicate operations)"`
+	MaxRetryAfter   time.Duration `flag:"max-retry-after" cmd:"pipeline,fetch,match,complete,complete-all" default:"5m" desc:"Longest server-requested Retry-After wait honored on HTTP 503; waits on HTTP 429 are capped at the backoff limit"`
+	MaxLoggedErrors int           `flag:"max-logged-errors" cmd:"pipeline,complete,complete-all" default:"500" desc:"Max failed runs written to errors.txt before a \"... and N more\" trailer (0 = unlimited)"`
+
+	Timeout         time.Duration `flag:"timeout" cmd:"pipeline,fetch,match,complete,complete-all" default:"0" desc:"Deadline of each pipeline stage that has no stage-specific timeout (0 = none)"`
+	FetchTimeout    time.Duration `flag:"fetch-timeout" cmd:"pipeline,fetch" default:"0" desc:"Deadline of the fetch stage (0 = use --timeout)"`
+	MatchTimeout    time.Duration `flag:"match-timeout" cmd:"pipeline,match" default:"0" desc:"Deadline of the match stage (0 = use --timeout)"`
+	CompleteTimeout time.Duration `flag:"complete-timeout" cmd:"pipeline,complete,complete-all" default:"0" desc:"Deadline of the complete stage, --complete-all included (0 = use --timeout)"`
+
+	ConcurrencyPerHost int           `flag:"concurrency-per-host" cmd:"pipeline,fetch,match,complete,complete-all" default:"0" desc:"Max simultaneous connections to the Qase API host (0 = unlimited)"`
+	ThrottleWarnRatio  float64       `flag:"throttle-warn-ratio" cmd:"pipeline,fetch,match,complete,complete-all" default:"0.05" desc:"Warn at exit when more than this share of API responses were HTTP 429 (0 = never)"`
+	MinRequestInterval time.Duration `flag:"min-request-interval" cmd:"pipeline,fetch,match,complete,complete-all" default:"0" desc:"Hard minimum gap between any two Qase API requests, on top of every stage's rate (0 = none)"`
+
+	RPS         int `flag:"rps" cmd:"pipeline,fetch,match,complete,complete-all" default:"0" desc:"API requests per second of every stage (0 = stage defaults: fetch 6, match 5, complete 5, complete-all 4)"`
+	Concurrency int `flag:"concurrency" cmd:"pipeline,fetch,match,complete,complete-all" default:"0" desc:"Max API requests in flight per stage (0 = stage defaults: fetch 6, match 5, complete-all 5)"`
+
+	ResultsPath  string `flag:"results-file" cmd:"pipeline,fetch,filter,match" default:"results.json" desc:"File fetch writes results to and filter and match read them from (.gz is appended with --compress-output)"`
+	FilteredPath string `flag:"filtered-file" cmd:"pipeline,filter,match" default:"filtered.txt" desc:"File filter writes the selected run IDs to and match reads them from"`
+	FinalPath    string `flag:"final-file" cmd:"pipeline,match,complete" default:"final.txt" desc:"File match writes the valid run IDs to and complete reads them from"`
+	ErrorsPath   string `flag:"errors-file" cmd:"pipeline,complete,complete-all" default:"errors.txt" desc:"File the runs that failed to complete are logged to"`
+
+	RunsFileFormat string `flag:"runs-file-format" cmd:"pipeline,filter,match,complete" default:"auto" desc:"Format of filtered.txt/final.txt: auto, csv or json"`
+	QuarantineFile string `flag:"quarantine-file" cmd:"pipeline,match" desc:"Write run IDs rejected by the match stage to this file"`
+	MatchStatuses  string `flag:"match-statuses" cmd:"pipeline,match" default:"active" desc:"Comma-separated run statuses the match stage accepts: active, complete, abort or numeric codes"`
+	Validators     string `flag:"validators" cmd:"pipeline,match" default:"latest-passed" desc:"Comma-separated rules a run must pass in match: latest-passed, all-cases-present, no-flaky, min-pass-rate=<0..1>"`
+	ValidateOnly   bool   `flag:"validate-only" cmd:"pipeline,match" default:"false" desc:"Run match, print valid and invalid run IDs with reasons, write final.preview.txt and stop before complete"`
+	DryRun         bool   `flag:"dry-run" cmd:"pipeline,complete,complete-all" default:"false" desc:"Go through the complete stage, rate limits included, but only print the runs that would be completed"`
+
+	CacheDir string        `flag:"cache-dir" cmd:"pipeline,match" desc:"Cache the run lookups of match in this directory and reuse them instead of asking the API again"`
+	CacheTTL time.Duration `flag:"cache-ttl" cmd:"pipeline,match" default:"1h" desc:"With --cache-dir, how long a cached run lookup is used before the run is fetched again"`
+
+	FetchRunIDs       []int         `flag:"fetch-run-ids" cmd:"pipeline,fetch" desc:"Only fetch results of these comma-separated run IDs"`
+	FetchParams       []string      `flag:"fetch-param" cmd:"pipeline,fetch" desc:"Extra key=value query parameter for result-list requests; repeatable"`
+	FetchPartition    string        `flag:"fetch-partition" cmd:"pipeline,fetch" desc:"Fetch results in end-time windows of this size (day, week, month or year) to stay under the API's offset ceiling"`
+	FetchFrom         time.Time     `flag:"fetch-from" cmd:"pipeline,fetch" desc:"With --fetch-partition, start of the first window (RFC3339 or YYYY-MM-DD)"`
+	FetchTo           time.Time     `flag:"fetch-to" cmd:"pipeline,fetch" desc:"With --fetch-partition, end of the last window (default now)"`
+	MaxResultsBytes   int           `flag:"max-results-bytes" cmd:"pipeline,fetch" default:"0" desc:"Abort fetch once results.json would exceed this many bytes (0 = unlimited)"`
+	CompressOutput    bool          `flag:"compress-output" cmd:"pipeline,fetch,filter,match" default:"false" desc:"Write results.json.gz (gzip) instead of results.json; filter and match read it transparently"`
+	MaxInFlightBytes  int           `flag:"max-in-flight-bytes" cmd:"pipeline,fetch" default:"0" desc:"Stop starting result page requests while fetched but unwritten pages hold about this many bytes (0 = unlimited)"`
+	FetchReport       string        `flag:"fetch-report" cmd:"pipeline,fetch" desc:"Write a JSON summary of the fetch phase to this file (- for stdout)"`
+	Pretty            bool          `flag:"pretty" cmd:"pipeline,fetch" default:"false" desc:"Indent the JSON of --fetch-report, the one report written compact; results.json stays one result per line"`
+	VerifyResults     bool          `flag:"verify-results" cmd:"pipeline,fetch" default:"false" desc:"After fetch, check the results file holds exactly the expected number of lines and report a mismatch as an error"`
+	ConcurrentStages  bool          `flag:"concurrent-stages" cmd:"pipeline" default:"false" desc:"Experimental: filter results while fetch is still streaming them"`
+	InMemory          bool          `flag:"in-memory" cmd:"pipeline" default:"false" desc:"Pass data between stages in memory instead of results.json, filtered.txt and final.txt"`
+	ResultsGlob       string        `flag:"results-glob" cmd:"pipeline,filter" desc:"Comma-separated globs of results files for filter to merge (default results.json)"`
+	TimeSkewTolerance time.Duration `flag:"time-skew-tolerance" cmd:"pipeline,filter,match" default:"0" desc:"Results of a case whose end_time differs by at most this much count as simultaneous: a non-passed result wins, then the later file position"`
+	MinResults        int           `flag:"min-results" cmd:"pipeline,filter" default:"1" desc:"Filter skips runs with fewer results than this"`
+	StrictPass        bool          `flag:"strict-pass" cmd:"pipeline,filter" default:"false" desc:"Filter keeps only runs where every result passed, not just the latest result of every case"`
+	DiffFiltered      string        `flag:"diff-filtered" cmd:"pipeline,filter" desc:"Print run IDs added/removed compared to this previous filtered.txt"`
+	FilterEvents      string        `flag:"filter-events" cmd:"pipeline,filter" desc:"Write filter's decision for every run as NDJSON to this file (- for stdout)"`
+
+	Force                bool   `flag:"force" cmd:"pipeline,complete" default:"false" desc:"Complete runs from final.txt even if it was generated for a different project"`
+	APIVersion           string `flag:"api-version" cmd:"pipeline,fetch,match,complete,complete-all" default:"v1" desc:"Qase API version segment used in every request URL"`
+	CompletePath         string `flag:"complete-path" cmd:"pipeline,complete,complete-all" default:"/run/%s/%d/complete" desc:"Version-relative path template of the complete endpoint (%s = project code, %d = run ID)"`
+	StrictCompleteStatus bool   `flag:"strict-complete-status" cmd:"pipeline,complete,complete-all" default:"false" desc:"Only count a completion as successful when the response says \"status\": true"`
+
+	CompletionFields []string `flag:"completion-field" cmd:"pipeline,complete,complete-all" desc:"Field key=value sent in a JSON body with every completion, for workflows that require one; value is JSON if valid, else a string; repeatable"`
+
+	SkipCompleted bool `flag:"skip-completed" cmd:"pipeline,complete,complete-all" default:"false" desc:"Look up each run before completing it and skip runs that are no longer in progress, counting them as successes"`
+
+	StartAfter  time.Time `flag:"start-after" cmd:"pipeline,complete-all" desc:"With --complete-all, only complete runs started after this time (RFC3339 or YYYY-MM-DD)"`
+	StartBefore time.Time `flag:"start-before" cmd:"pipeline,complete-all" desc:"With --complete-all, only complete runs started before this time (RFC3339 or YYYY-MM-DD)"`
+
+	ListInProgress bool   `flag:"list-in-progress" cmd:"pipeline,complete-all" default:"false" desc:"Only list the runs --complete-all would complete, as JSON, and exit"`
+	ListOutput     string `flag:"list-output" cmd:"pipeline,complete-all" default:"in_progress.json" desc:"Where --list-in-progress writes its JSON (- for stdout)"`
+
+	EstimateQuota  bool `flag:"estimate-quota" cmd:"pipeline,complete,complete-all" default:"false" desc:"Print the estimated API request count and duration of the selected mode and exit"`
+	ValidateConfig bool `flag:"validate-config" default:"false" desc:"Only run the local preflight checks (writable working directory, input files, output directories) and exit"`
+
+	MaxDuration time.Duration `flag:"max-duration" cmd:"pipeline,complete-all" default:"0" desc:"With --complete-all, stop starting new completions after this long (0 = no limit)"`
+	SweepOrder  string        `flag:"sweep-order" cmd:"pipeline,complete-all" default:"oldest" desc:"With --complete-all, order in which runs are completed: oldest, newest or id"`
+
+	CheckpointFile string `flag:"checkpoint-file" cmd:"pipeline,complete-all" desc:"With --complete-all, record completed run IDs here and skip runs already recorded, to resume an interrupted sweep"`
+	StreamSweep    bool   `flag:"stream-sweep" cmd:"pipeline,complete-all" default:"false" desc:"With --complete-all, start completing runs while they are still being listed, in listing order, instead of collecting them first"`
+
+	ProgressInterval time.Duration `flag:"progress-interval" cmd:"pipeline,complete,complete-all" default:"0" desc:"Print a progress line with counts and an ETA this often while listing and completing runs (0 = never)"`
+
+	OnlyNew   bool   `flag:"only-new" cmd:"pipeline,complete" default:"false" desc:"Only complete runs from final.txt not completed by an earlier invocation, according to --state-file"`
+	StateFile string `flag:"state-file" cmd:"pipeline,complete" default:"completed_runs.txt" desc:"With --only-new, file of run IDs completed by earlier invocations; successful completions are appended"`
+
+	ByTitle []string `flag:"by-title" cmd:"pipeline,complete" desc:"Complete the run with exactly this title instead of running the pipeline; repeatable"`
+	ByKey   []string `flag:"by-key" cmd:"pipeline,complete" desc:"Complete the run with this key, e.g. DEMO-42, instead of running the pipeline; repeatable"`
+	RunIDs  []int    `flag:"run-ids" cmd:"pipeline,complete" desc:"Complete only these comma-separated run IDs, e.g. 123,456, instead of running the pipeline"`
+
+	FailedFile  string `flag:"failed-file" cmd:"pipeline,complete,complete-all" desc:"Write the runs that failed to complete as JSON (run ID, HTTP status or error, time) to this file, for --retry-failed"`
+	RetryFailed string `flag:"retry-failed" cmd:"pipeline,complete" desc:"Complete only the runs listed in this --failed-file output instead of running the pipeline"`
+
+	CompleteReport string `flag:"complete-report" cmd:"pipeline,complete,complete-all" desc:"Write a JSON summary of the complete phase (counts, per-run status, duration) to this file (- for stdout)"`
+
+	CompletedWebhookPerRun string        `flag:"completed-webhook-per-run" cmd:"pipeline,complete,complete-all" desc:"POST {run_id, success, timestamp} to this URL after each completion attempt (best effort)"`
+	WebhookConcurrency     int           `flag:"webhook-concurrency" cmd:"pipeline,complete,complete-all" default:"4" desc:"Max per-run webhook callbacks in flight; callbacks beyond it are dropped"`
+	WebhookTimeout         time.Duration `flag:"webhook-timeout" cmd:"pipeline,fetch,complete,complete-all" default:"5s" desc:"Timeout of each per-run webhook callback and of the summary webhook"`
+	SummaryWebhook         string        `flag:"summary-webhook" cmd:"pipeline,fetch,complete,complete-all" desc:"POST a JSON summary of the invocation (outcome, fetch and complete reports) to this URL at exit"`
+	NotifyOnFailureOnly    bool          `flag:"notify-on-failure-only" cmd:"pipeline,fetch,complete,complete-all" default:"false" desc:"With --summary-webhook, only send the summary when runs failed to complete or fetch was incomplete"`
+}
+
+// Defaults returns a Config holding every field's default, without reading
+// the environment or the command line, for running the stages from another
+// program. Set the fields to change, then call Validate.
+func Defaults() (*Config, error) {
+	cfg := &Config{}
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if def, ok := t.Field(i).Tag.Lookup("default"); ok {
+			if err := setValue(v.Field(i), def); err != nil {
+				return nil, fmt.Errorf("invalid default for %s: %v", t.Field(i).Name, err)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// Load builds a Config from the field defaults, the environment and the
+// command-line flags, in that order of precedence.
+// Each command parses its own flag set, so a flag that does not apply to it is
+// rejected instead of silently ignored, and "<command> --help" lists only the
+// flags of that command.
+func Load() (*Config, error) {
+	cfg := &Config{}
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+
+	// An optional first argument names the command; the flags follow it
+	command, args := CommandPipeline, os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	if _, ok := commandHelp[command]; !ok {
+		return nil, fmt.Errorf("unknown command %q; use pipeline, fetch, filter, match, complete or complete-all", command)
+	}
+	// flags holds every flag, so one of another command can be named in the
+	// error; help holds only those of command, for --help
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	help := flag.NewFlagSet(command, flag.ContinueOnError)
+	fields := make(map[string]reflect.StructField)
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i)
+
+		if def, ok := field.Tag.Lookup("default"); ok {
+			if err := setValue(value, def); err != nil {
+				return nil, fmt.Errorf("invalid default for %s: %v", field.Name, err)
+			}
+		}
+
+		if env := field.Tag.Get("env"); env != "" {
+			if raw := os.Getenv(env); raw != "" {
+				if err := setValue(value, raw); err != nil {
+					return nil, fmt.Errorf("invalid value for %s: %v", env, err)
+				}
+			}
+		}
+
+		if name := field.Tag.Get("flag"); name != "" {
+			if err := registerFlag(flags, value, name, field.Tag.Get("desc")); err != nil {
+				return nil, fmt.Errorf("cannot register flag for %s: %v", field.Name, err)
+			}
+			fields[name] = field
+			if appliesTo(field, command) {
+				registerFlag(help, value, name, field.Tag.Get("desc"))
+			}
+		}
+	}
+
+	flags.Usage = func() {
+		out := flags.Output()
+		fmt.Fprintf(out, "Usage: %s %s [flags]\n\n%s\n\nFlags:\n", os.Args[0], command, commandHelp[command])
+		help.SetOutput(out)
+		help.PrintDefaults()
+		if command == CommandPipeline {
+			fmt.Fprintf(out, "\nOther commands: fetch, filter, match, complete and complete-all; \"%s <command> --help\" lists their flags.\n", os.Args[0])
+		}
+	}
+	flags.Parse(args) // Exits on a bad flag, like flag.Parse
+	cfg.Command = command
+	if cfg.Command == CommandCompleteAll {
+		cfg.CompleteAll = true
+	}
+
+	// A mode flag of the pipeline command selects the flags of the command it
+	// stands in for: --run-ids those of complete, --complete-all those of
+	// complete-all
+	var err error
+	mode := cfg.mode()
+	flags.Visit(func(f *flag.Flag) {
+		if err == nil && !appliesTo(fields[f.Name], mode) {
+			err = fmt.Errorf("--%s does not apply to the %s command; see %s %s --help", f.Name, mode, os.Args[0], mode)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.TokenFile != "" {
+		token, err := readTokenFile(cfg.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("QASE_API_TOKEN_FILE: %v", err)
+		}
+		cfg.APIToken = token
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Commands, given as the first argument. pipeline runs fetch, filter, match and
+// complete in turn; the stage commands run one stage on the files an earlier
+// invocation left behind.
+const (
+	CommandPipeline    = "pipeline"
+	CommandFetch       = "fetch"
+	CommandFilter      = "filter"
+	CommandMatch       = "match"
+	CommandComplete    = "complete"
+	CommandCompleteAll = "complete-all"
+)
+
+// What each command does, for --help
+var commandHelp = map[string]string{
+	CommandPipeline:    "Fetch results, select the runs where every case passed, validate them against the API and complete them.",
+	CommandFetch:       "Fetch the result list into --results-file.",
+	CommandFilter:      "Select the runs of --results-file whose latest results passed into --filtered-file.",
+	CommandMatch:       "Validate the runs of --filtered-file against the API and write the valid ones to --final-file.",
+	CommandComplete:    "Complete the runs of --final-file, or those given by --run-ids, --by-title, --by-key or --retry-failed.",
+	CommandCompleteAll: "Complete every in-progress run of the project, or list them with --list-in-progress.",
+}
+
+// appliesTo reports whether the flag of field applies to command
+func appliesTo(field reflect.StructField, command string) bool {
+	commands, ok := field.Tag.Lookup("cmd")
+	if !ok {
+		return true
+	}
+	for _, c := range strings.Split(commands, ",") {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+// mode is the command the configuration runs as. It is the command itself,
+// except that the pipeline command runs as complete or complete-all when a
+// mode flag replaces the pipeline, in the order main checks them.
+func (c *Config) mode() string {
+	if c.Command != CommandPipeline {
+		return c.Command
+	}
+	switch {
+	case c.ListInProgress:
+		return CommandCompleteAll
+	case len(c.ByTitle) > 0 || len(c.ByKey) > 0 || len(c.RunIDs) > 0 || c.RetryFailed != "":
+		return CommandComplete
+	case c.CompleteAll:
+		return CommandCompleteAll
+	}
+	return CommandPipeline
+}
+
+// validateCommand checks the command and the mode flags that only make sense
+// with some of them
+func (c *Config) validateCommand() error {
+	switch c.Command {
+	case CommandPipeline, CommandCompleteAll:
+		return nil
+	case CommandFetch, CommandFilter, CommandMatch, CommandComplete:
+	default:
+		return fmt.Errorf("unknown command %q; use pipeline, fetch, filter, match, complete or complete-all", c.Command)
+	}
+
+	if c.CompleteAll || c.ListInProgress {
+		return fmt.Errorf("--complete-all and --list-in-progress cannot be used with the %s command; use the complete-all command", c.Command)
+	}
+	if c.InMemory || c.ConcurrentStages {
+		return fmt.Errorf("--in-memory and --concurrent-stages only apply to the pipeline command")
+	}
+	if c.Command != CommandComplete && (len(c.RunIDs) > 0 || len(c.ByTitle) > 0 || len(c.ByKey) > 0 || c.RetryFailed != "") {
+		return fmt.Errorf("--run-ids, --by-title, --by-key and --retry-failed only apply to the complete and pipeline commands")
+	}
+	if c.ValidateOnly && c.Command != CommandMatch {
+		return fmt.Errorf("--validate-only only applies to the match and pipeline commands")
+	}
+	return nil
+}
+
+// validateStdio checks the paths given as "-". The files the stages hand each
+// other can be stdin or stdout with the stage commands, which are piped into
+// each other, but not with the pipeline, which reads them back itself. Only
+// one file can be read from stdin, and a stage file written to stdout cannot
+// share it with another output.
+func (c *Config) validateStdio() error {
+	if c.mode() == CommandPipeline && !c.InMemory {
+		for _, file := range []struct{ flag, path string }{
+			{"--results-file", c.ResultsPath},
+			{"--filtered-file", c.FilteredPath},
+			{"--final-file", c.FinalPath},
+		} {
+			if file.path == "-" {
+				return fmt.Errorf("%s cannot be - with the pipeline command, which reads it back; pipe the stage commands into each other instead", file.flag)
+			}
+		}
+	}
+
+	var inputs, outputs []string
+	add := func(list *[]string, flag, path string) {
+		if path == "-" {
+			*list = append(*list, flag)
+		}
+	}
+	switch c.mode() {
+	case CommandFetch:
+		add(&outputs, "--results-file", c.ResultsPath)
+	case CommandFilter:
+		if c.ResultsGlob == "" {
+			add(&inputs, "--results-file", c.ResultsPath)
+		}
+		add(&outputs, "--filtered-file", c.FilteredPath)
+	case CommandMatch:
+		add(&inputs, "--filtered-file", c.FilteredPath)
+		add(&inputs, "--results-file", c.ResultsPath)
+		add(&outputs, "--final-file", c.FinalPath)
+	case CommandComplete:
+		add(&inputs, "--final-file", c.FinalPath)
+	}
+	add(&outputs, "--quarantine-file", c.QuarantineFile)
+	add(&outputs, "--errors-file", c.ErrorsPath)
+	stageOutputs := len(outputs)
+	if c.ListInProgress {
+		add(&outputs, "--list-output", c.ListOutput)
+	}
+	add(&outputs, "--fetch-report", c.FetchReport)
+	add(&outputs, "--filter-events", c.FilterEvents)
+	add(&outputs, "--complete-report", c.CompleteReport)
+	add(&outputs, "--error-report", c.ErrorReport)
+	if c.Events {
+		outputs = append(outputs, "--events")
+	}
+
+	if len(inputs) > 1 {
+		return fmt.Errorf("only one of %s can read stdin", strings.Join(inputs, " and "))
+	}
+	if stageOutputs > 0 && len(outputs) > 1 {
+		return fmt.Errorf("only one of %s can write to stdout", strings.Join(outputs, ", "))
+	}
+	return nil
+}
+
+// ResultsFile is the results file fetch writes and filter and match read
+func (c *Config) ResultsFile() string {
+	if c.CompressOutput && c.ResultsPath != "-" && !strings.HasSuffix(c.ResultsPath, ".gz") {
+		return c.ResultsPath + ".gz"
+	}
+	return c.ResultsPath
+}
+
+// PreviewFile is where --validate-only writes the valid run IDs so the final
+// file is left untouched: final.txt becomes final.preview.txt. Stdout ("-")
+// stays stdout.
+func (c *Config) PreviewFile() string {
+	if c.FinalPath == "-" {
+		return c.FinalPath
+	}
+	ext := filepath.Ext(c.FinalPath)
+	return strings.TrimSuffix(c.FinalPath, ext) + ".preview" + ext
+}
+
+// WritesToStdout reports whether any output path of the selected mode is "-",
+// or the event stream is on. The files the stages hand each other count as
+// well: when one is read from stdin, the command is part of a shell pipe whose
+// next command may read its stdout.
+func (c *Config) WritesToStdout() bool {
+	if c.Events || c.ErrorReport == "-" {
+		return true
+	}
+	for _, path := range []string{c.ResultsPath, c.FilteredPath, c.FinalPath, c.ErrorsPath} {
+		if path == "-" {
+			return true
+		}
+	}
+	if c.ListInProgress {
+		return c.ListOutput == "-"
+	}
+	return c.FetchReport == "-" || c.FilterEvents == "-" || c.CompleteReport == "-"
+}
+
+// StageContext returns the context a stage runs under: it ends with parent, and
+// expires after stageTimeout, or after --timeout when stageTimeout is unset
+func (c *Config) StageContext(parent context.Context, stageTimeout time.Duration) (context.Context, context.CancelFunc) {
+	timeout := stageTimeout
+	if timeout <= 0 {
+		timeout = c.Timeout
+	}
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// StopReason says why a stage context ended early, for log messages: "timed
+// out" after a deadline, "interrupted" when the process was asked to stop
+func StopReason(ctx context.Context) string {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return "timed out"
+	}
+	return "interrupted"
+}
+
+// StageRPS returns the request rate of a stage: --rps, or def when it is unset
+func (c *Config) StageRPS(def int) int {
+	if c.RPS > 0 {
+		return c.RPS
+	}
+	return def
+}
+
+// StageConcurrency returns how many requests a stage may have in flight:
+// --concurrency, or def when it is unset
+func (c *Config) StageConcurrency(def int) int {
+	if c.Concurrency > 0 {
+		return c.Concurrency
+	}
+	return def
+}
+
+// Upper bound of --concurrency; more parallel requests only earn HTTP 429s
+const maxConcurrency = 50
+
+// Upper bound of --rps. Far above any API rate limit, and well below the rate
+// at which the pacing interval time.Second/rps rounds down to zero.
+const maxRPS = 1000
+
+// Validate checks option values that cannot be expressed by their type alone
+func (c *Config) Validate() error {
+	switch c.RunsFileFormat {
+	case "auto", "csv", "json":
+	default:
+		return fmt.Errorf("--runs-file-format must be auto, csv or json, got %q", c.RunsFileFormat)
+	}
+	if _, err := ParseRunStatuses(c.MatchStatuses); err != nil {
+		return fmt.Errorf("--match-statuses: %v", err)
+	}
+	if _, err := ParseValidators(c.Validators); err != nil {
+		return fmt.Errorf("--validators: %v", err)
+	}
+	if _, err := CompletionBody(c.CompletionFields); err != nil {
+		return fmt.Errorf("--completion-field: %v", err)
+	}
+	for _, param := range c.FetchParams {
+		if _, _, err := ParseQueryParam(param); err != nil {
+			return fmt.Errorf("--fetch-param: %v", err)
+		}
+	}
+	switch c.FetchPartition {
+	case "":
+	case "day", "week", "month", "year":
+		if c.FetchFrom.IsZero() {
+			return fmt.Errorf("--fetch-partition requires --fetch-from")
+		}
+		if !c.FetchTo.IsZero() && !c.FetchFrom.Before(c.FetchTo) {
+			return fmt.Errorf("--fetch-from must be earlier than --fetch-to")
+		}
+	default:
+		return fmt.Errorf("--fetch-partition must be day, week, month or year, got %q", c.FetchPartition)
+	}
+	if c.TimeSkewTolerance < 0 {
+		return fmt.Errorf("--time-skew-tolerance must not be negative")
+	}
+	if c.MaxResultsBytes < 0 {
+		return fmt.Errorf("--max-results-bytes must not be negative")
+	}
+	if c.MaxInFlightBytes < 0 {
+		return fmt.Errorf("--max-in-flight-bytes must not be negative")
+	}
+	if err := c.validateCommand(); err != nil {
+		return err
+	}
+	if (len(c.ByTitle) > 0 || len(c.ByKey) > 0) && (c.CompleteAll || c.ListInProgress) {
+		return fmt.Errorf("--by-title and --by-key cannot be combined with --complete-all or --list-in-progress")
+	}
+	if c.RetryFailed != "" && (c.CompleteAll || c.ListInProgress || len(c.ByTitle) > 0 || len(c.ByKey) > 0) {
+		return fmt.Errorf("--retry-failed cannot be combined with --complete-all, --list-in-progress, --by-title or --by-key")
+	}
+	if len(c.RunIDs) > 0 {
+		if c.CompleteAll || c.ListInProgress || len(c.ByTitle) > 0 || len(c.ByKey) > 0 || c.RetryFailed != "" {
+			return fmt.Errorf("--run-ids cannot be combined with --complete-all, --list-in-progress, --by-title, --by-key or --retry-failed")
+		}
+		// These only change how the pipeline runs, which --run-ids skips
+		if c.InMemory || c.ConcurrentStages || c.ValidateOnly {
+			return fmt.Errorf("--run-ids skips the pipeline and cannot be combined with --in-memory, --concurrent-stages or --validate-only")
+		}
+		seen := make(map[int]bool, len(c.RunIDs))
+		for _, id := range c.RunIDs {
+			if seen[id] {
+				return fmt.Errorf("--run-ids lists run %d more than once", id)
+			}
+			seen[id] = true
+		}
+	}
+	if c.InMemory && c.ConcurrentStages {
+		return fmt.Errorf("--in-memory and --concurrent-stages cannot be combined")
+	}
+	for _, file := range []struct{ flag, path string }{
+		{"--results-file", c.ResultsPath},
+		{"--filtered-file", c.FilteredPath},
+		{"--final-file", c.FinalPath},
+		{"--errors-file", c.ErrorsPath},
+	} {
+		if file.path == "" {
+			return fmt.Errorf("%s must be a file path, or - for stdin or stdout", file.flag)
+		}
+	}
+	if err := c.validateStdio(); err != nil {
+		return err
+	}
+	if c.RPS < 0 || c.RPS > maxRPS {
+		return fmt.Errorf("--rps must be between 1 and %d requests per second, or 0 for the stage defaults", maxRPS)
+	}
+	if c.Concurrency < 0 || c.Concurrency > maxConcurrency {
+		return fmt.Errorf("--concurrency must be between 1 and %d, or 0 for the stage defaults", maxConcurrency)
+	}
+	if c.ThrottleWarnRatio < 0 || c.ThrottleWarnRatio > 1 {
+		return fmt.Errorf("--throttle-warn-ratio must be between 0 and 1")
+	}
+	if c.NotifyOnFailureOnly && c.SummaryWebhook == "" {
+		return fmt.Errorf("--notify-on-failure-only requires --summary-webhook")
+	}
+	if c.WebhookConcurrency < 1 {
+		return fmt.Errorf("--webhook-concurrency must be at least 1")
+	}
+	if c.Timeout < 0 || c.FetchTimeout < 0 || c.MatchTimeout < 0 || c.CompleteTimeout < 0 {
+		return fmt.Errorf("--timeout and the stage timeouts must not be negative")
+	}
+	if c.MinRequestInterval < 0 {
+		return fmt.Errorf("--min-request-interval must not be negative")
+	}
+	if c.ConcurrencyPerHost < 0 {
+		return fmt.Errorf("--concurrency-per-host must not be negative")
+	}
+	if c.MaxLoggedErrors < 0 {
+		return fmt.Errorf("--max-logged-errors must not be negative")
+	}
+	if c.ReadRetries < 0 || c.CompleteRetries < 0 {
+		return fmt.Errorf("--read-retries and --complete-retries must not be negative")
+	}
+	if c.MaxRetryAfter < 0 {
+		return fmt.Errorf("--max-retry-after must not be negative")
+	}
+	switch c.SweepOrder {
+	case "oldest", "newest", "id":
+	default:
+		return fmt.Errorf("--sweep-order must be oldest, newest or id, got %q", c.SweepOrder)
+	}
+	if c.APIBaseURL != "" {
+		if err := validateBaseURL(c.APIBaseURL); err != nil {
+			return fmt.Errorf("QASE_API_BASE_URL: %v", err)
+		}
+	}
+	if !apiVersionPattern.MatchString(c.APIVersion) {
+		return fmt.Errorf("--api-version must look like v1, got %q", c.APIVersion)
+	}
+	if err := validatePathTemplate(c.CompletePath, "%s", "%d"); err != nil {
+		return fmt.Errorf("--complete-path: %v", err)
+	}
+	if c.CacheDir != "" && c.CacheTTL <= 0 {
+		return fmt.Errorf("--cache-ttl must be positive with --cache-dir, got %v", c.CacheTTL)
+	}
+	if !c.StartAfter.IsZero() && !c.StartBefore.IsZero() && !c.StartAfter.Before(c.StartBefore) {
+		return fmt.Errorf("--start-after (%s) must be earlier than --start-before (%s)",
+			c.StartAfter.Format(time.RFC3339), c.StartBefore.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// readTokenFile reads the API token from path, without trailing whitespace. An
+// empty file is an error rather than a request with an empty Token header.
+func readTokenFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return token, nil
+}
+
+// PrintHelp writes a table of every configuration option to w.
+func PrintHelp(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tENV\tFLAG\tDEFAULT\tDESCRIPTION")
+
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			field.Name,
+			orDash(field.Tag.Get("env")),
+			orDash(flagName(field.Tag.Get("flag"))),
+			orDash(field.Tag.Get("default")),
+			field.Tag.Get("desc"))
+	}
+	tw.Flush()
+}
+
+func flagName(name string) string {
+	if name == "" {
+		return ""
+	}
+	return "--" + name
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// setValue parses raw into the field according to its type.
+func setValue(value reflect.Value, raw string) error {
+	switch value.Interface().(type) {
+	case string:
+		value.SetString(raw)
+	case bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(n))
+	case float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		value.SetFloat(f)
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(d))
+	case time.Time:
+		t, err := ParseTime(raw)
+		if err != nil {
+			return err
+		}
+		value.Set(reflect.ValueOf(t))
+	case []string:
+		var values []string
+		for _, part := range strings.Split(raw, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				values = append(values, part)
+			}
+		}
+		value.Set(reflect.ValueOf(values))
+	case []int:
+		ids, err := ParseIDList(raw)
+		if err != nil {
+			return err
+		}
+		value.Set(reflect.ValueOf(ids))
+	default:
+		return fmt.Errorf("unsupported type %s", value.Type())
+	}
+	return nil
+}
+
+// registerFlag binds a flag of flags directly to the field, using the
+// field's current value (default or environment) as the flag default.
+func registerFlag(flags *flag.FlagSet, value reflect.Value, name, usage string) error {
+	switch ptr := value.Addr().Interface().(type) {
+	case *string:
+		flags.StringVar(ptr, name, *ptr, usage)
+	case *bool:
+		flags.BoolVar(ptr, name, *ptr, usage)
+	case *int:
+		flags.IntVar(ptr, name, *ptr, usage)
+	case *float64:
+		flags.Float64Var(ptr, name, *ptr, usage)
+	case *time.Duration:
+		flags.DurationVar(ptr, name, *ptr, usage)
+	case *time.Time:
+		flags.Func(name, usage, func(raw string) error {
+			t, err := ParseTime(raw)
+			if err != nil {
+				return err
+			}
+			*ptr = t
+			return nil
+		})
+	case *[]string:
+		// Repeatable: every occurrence adds one value
+		flags.Func(name, usage, func(raw string) error {
+			*ptr = append(*ptr, raw)
+			return nil
+		})
+	case *[]int:
+		flags.Func(name, usage, func(raw string) error {
+			ids, err := ParseIDList(raw)
+			if err != nil {
+				return err
+			}
+			*ptr = ids
+			return nil
+		})
+	default:
+		return fmt.Errorf("unsupported type %s", value.Type())
+	}
+	return nil
+}
+
+var apiVersionPattern = regexp.MustCompile(`^v[0-9]+$`)
+
+// validateBaseURL checks that raw is an absolute http(s) URL without a query,
+// so paths can be appended to it
+func validateBaseURL(raw string) error {
+	u, err := url.Parse(strings.TrimRight(raw, "/"))
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q must be an absolute http or https URL, e.g. https://qase.example.com/v1", raw)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("%q must not have a query or fragment", raw)
+	}
+	return nil
+}
+
+// validatePathTemplate checks that tmpl is an absolute path whose formatting
+// verbs are exactly the given ones, in order. A literal percent is written %%.
+func validatePathTemplate(tmpl string, verbs ...string) error {
+	if !strings.HasPrefix(tmpl, "/") {
+		return fmt.Errorf("path template %q must start with /", tmpl)
+	}
+
+	var found []string
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] != '%' {
+			continue
+		}
+		if i+1 == len(tmpl) {
+			return fmt.Errorf("path template %q ends with a lone %%", tmpl)
+		}
+		i++
+		if tmpl[i] != '%' {
+			found = append(found, "%"+string(tmpl[i]))
+		}
+	}
+
+	if strings.Join(found, "") != strings.Join(verbs, "") {
+		return fmt.Errorf("path template %q must contain %s in that order, found %v",
+			tmpl, strings.Join(verbs, " then "), found)
+	}
+	return nil
+}
+
+// timeLayouts are the formats accepted for date/time options
+var timeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+// ParseTime parses a date/time option value, accepting RFC3339 or a plain date
+func ParseTime(raw string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, raw); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q as a date or RFC3339 time", raw)
+}
+
+// ParseIDList parses a comma-separated list of positive IDs such as "12,34"
+func ParseIDList(raw string) ([]int, error) {
+	var ids []int
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.Atoi(part)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("%q is not a positive integer ID", part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Query parameters set by fetch itself, which --fetch-param must not override
+var reservedQueryParams = map[string]bool{"limit": true, "offset": true}
+
+// ParseQueryParam splits a key=value query parameter
+func ParseQueryParam(raw string) (key, value string, err error) {
+	key, value, ok := strings.Cut(raw, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return "", "", fmt.Errorf("%q is not of the form key=value", raw)
+	}
+	if reservedQueryParams[key] {
+		return "", "", fmt.Errorf("%q is set by fetch and cannot be overridden", key)
+	}
+	return key, value, nil
+}
+
+// CompletionBody builds the JSON body sent when completing a run from key=value
+// fields. A value that is valid JSON (a number, true, an object, a quoted
+// string) is sent as is; anything else is sent as a string. Without fields the
+// body is nil, i.e. the request has no body.
+func CompletionBody(fields []string) ([]byte, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	body := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%q is not of the form key=value", field)
+		}
+		if _, dup := body[key]; dup {
+			return nil, fmt.Errorf("field %q is given twice", key)
+		}
+		raw := json.RawMessage(value)
+		if !json.Valid(raw) {
+			raw, _ = json.Marshal(value)
+		}
+		body[key] = raw
+	}
+	return json.Marshal(body)
+}
+
+// RunStatuses maps the run status names accepted on the command line to the
+// codes the Qase API reports
+var RunStatuses = map[string]int{
+	"active":   0,
+	"complete": 1,
+	"abort":    2,
+}
+
+// ParseRunStatuses parses a comma-separated list of run status names or
+// numeric codes
+func ParseRunStatuses(raw string) ([]int, error) {
+	var statuses []int
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if code, ok := RunStatuses[part]; ok {
+			statuses = append(statuses, code)
+			continue
+		}
+		code, err := strconv.Atoi(part)
+		if err != nil || code < 0 {
+			return nil, fmt.Errorf("%q is not a run status name or code", part)
+		}
+		statuses = append(statuses, code)
+	}
+	if len(statuses) == 0 {
+		return nil, fmt.Errorf("at least one run status is required")
+	}
+	return statuses, nil
+}
+
+// ValidatorSpec is one match validation rule named in --validators, with its
+// argument if it takes one
+type ValidatorSpec struct {
+	Name string
+	Arg  float64
+}
+
+// Validators lists the known match validation rules and whether they take an
+// argument, e.g. min-pass-rate=0.9
+var Validators = map[string]bool{
+	"latest-passed":     false,
+	"all-cases-present": false,
+	"no-flaky":          false,
+	"min-pass-rate":     true,
+}
+
+// ParseValidators parses a comma-separated list of validation rules
+func ParseValidators(raw string) ([]ValidatorSpec, error) {
+	var specs []ValidatorSpec
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, arg, hasArg := strings.Cut(part, "=")
+		takesArg, ok := Validators[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown validator %q", name)
+		}
+		spec := ValidatorSpec{Name: name}
+		switch {
+		case takesArg && !hasArg:
+			return nil, fmt.Errorf("%s needs a value, e.g. %s=0.9", name, name)
+		case !takesArg && hasArg:
+			return nil, fmt.Errorf("%s takes no value", name)
+		case takesArg:
+			value, err := strconv.ParseFloat(arg, 64)
+			if err != nil || value < 0 || value > 1 {
+				return nil, fmt.Errorf("%s must be between 0 and 1, got %q", name, arg)
+			}
+			spec.Arg = value
+		}
+		specs = append(specs, spec)
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("at least one validator is required")
+	}
+	return specs, nil
+}
@@ -0,0 +1,82 @@
+package curl
+
+import (
+	"complete_run/redact"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	enabled bool
+	mutex   = &sync.Mutex{}
+	printed = make(map[string]bool)
+)
+
+// Enable turns on printing of equivalent curl commands
+func Enable() {
+	enabled = true
+}
+
+// Fprint logs to w a copy-pasteable curl command equivalent to req, once per
+// request kind. The token is replaced by a reference to $QASE_API_TOKEN so it
+// never appears in the output.
+func Fprint(w io.Writer, kind string, req *http.Request) {
+	if !enabled {
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if printed[kind] {
+		return
+	}
+	printed[kind] = true
+
+	// The URL carries project and run IDs, which --redact promises to hide
+	if redact.Enabled() {
+		fmt.Fprintf(w, "curl for %s request not printed because --redact is on\n", kind)
+		return
+	}
+	fmt.Fprintf(w, "curl for %s request:\n  %s\n", kind, Command(req))
+}
+
+// Command builds the curl command line for req, body included
+func Command(req *http.Request) string {
+	parts := []string{"curl", "-X", req.Method, quote(req.URL.String())}
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, value := range req.Header[name] {
+			if strings.EqualFold(name, "Token") {
+				parts = append(parts, "-H", `"`+name+`: $QASE_API_TOKEN"`)
+				continue
+			}
+			parts = append(parts, "-H", quote(name+": "+value))
+		}
+	}
+
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			data, _ := io.ReadAll(body)
+			body.Close()
+			if len(data) > 0 {
+				parts = append(parts, "-d", quote(string(data)))
+			}
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// quote wraps s in single quotes for a POSIX shell
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
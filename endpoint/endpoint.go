@@ -0,0 +1,37 @@
+package endpoint
+
+import (
+	"fmt"
+	"strings"
+)
+
+const host = "https://api.qase.io"
+
+// API version segment used in every request URL. Overridable via --api-version.
+var version = "v1"
+
+// SetVersion selects the API version, e.g. "v2". Call it before any request is made.
+func SetVersion(v string) {
+	version = v
+}
+
+// Versioned base URL of a self-hosted instance, replacing host and version.
+// Set via QASE_API_BASE_URL.
+var base string
+
+// SetBaseURL points every request at a self-hosted Qase instance, e.g.
+// https://qase.example.com/v1. Trailing slashes are dropped. Call it before any
+// request is made.
+func SetBaseURL(u string) {
+	base = strings.TrimRight(u, "/")
+}
+
+// URL builds a request URL from a version-relative path format such as
+// "/run/%s/%d", e.g. https://api.qase.io/v1/run/DEMO/12
+func URL(format string, args ...interface{}) string {
+	prefix := host + "/" + version
+	if base != "" {
+		prefix = base
+	}
+	return prefix + fmt.Sprintf(format, args...)
+}
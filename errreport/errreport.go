@@ -0,0 +1,128 @@
+package errreport
+
+import (
+	"complete_run/clock"
+	"complete_run/stdio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Severity tells errors, which lose data or leave work undone, from warnings
+type Severity string
+
+const (
+	Error   Severity = "error"
+	Warning Severity = "warning"
+)
+
+// Entry is one problem reported by a stage. Context locates it, e.g.
+// "offset=300" or "run=123". Messages are recorded as logged, so they are
+// redacted with --redact.
+type Entry struct {
+	Time     string   `json:"time"`
+	Stage    string   `json:"stage"`
+	Severity Severity `json:"severity"`
+	Context  string   `json:"context,omitempty"`
+	Message  string   `json:"message"`
+}
+
+// Entries beyond this many are left out of the console summary, not the file
+const maxPrinted = 20
+
+var (
+	mu      sync.Mutex
+	entries []Entry
+	clk     = clock.Real
+)
+
+// Logger logs problems to its writer before recording them
+type Logger struct {
+	w io.Writer
+}
+
+// To returns a Logger writing its lines to w
+func To(w io.Writer) Logger {
+	return Logger{w: w}
+}
+
+// Errorf logs an error like fmt.Printf, with a newline added, and records it
+func (l Logger) Errorf(stage, context, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	fmt.Fprintln(l.w, message)
+	Record(Error, stage, context, message)
+}
+
+// Warnf logs a warning like fmt.Printf, with a newline added, and records it
+func (l Logger) Warnf(stage, context, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	fmt.Fprintln(l.w, message)
+	Record(Warning, stage, context, message)
+}
+
+// Record adds a problem without logging it, for stages that already logged it
+// in their own format. It is safe for concurrent use.
+func Record(severity Severity, stage, context, message string) {
+	entry := Entry{
+		Time:     clk.Now().UTC().Format(time.RFC3339),
+		Stage:    stage,
+		Severity: severity,
+		Context:  context,
+		Message:  message,
+	}
+	mu.Lock()
+	entries = append(entries, entry)
+	mu.Unlock()
+}
+
+// Report prints a summary of every recorded problem to w and writes them all
+// as a JSON array to path, or stdout for "-". The file is written even when there
+// were no problems, so a file left over from an earlier invocation is never
+// mistaken for this one's. An empty path skips the file.
+func Report(w io.Writer, path string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(entries) > 0 {
+		errorCount := 0
+		for _, entry := range entries {
+			if entry.Severity == Error {
+				errorCount++
+			}
+		}
+		fmt.Fprintf(w, "\nError report: %d errors, %d warnings\n", errorCount, len(entries)-errorCount)
+		for i, entry := range entries {
+			if i == maxPrinted {
+				fmt.Fprintf(w, "  ... and %d more\n", len(entries)-maxPrinted)
+				break
+			}
+			location := entry.Stage
+			if entry.Context != "" {
+				location += " " + entry.Context
+			}
+			fmt.Fprintf(w, "  [%s] %s: %s\n", location, entry.Severity, entry.Message)
+		}
+	}
+	if path == "" {
+		return
+	}
+
+	list := entries
+	if list == nil {
+		list = []Entry{}
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		fmt.Fprintln(w, "Error encoding error report:", err)
+		return
+	}
+	if err := stdio.WriteFile(path, append(data, '\n')); err != nil {
+		fmt.Fprintln(w, "Error writing error report:", err)
+		return
+	}
+	if len(entries) > 0 && path != stdio.Name {
+		fmt.Fprintf(w, "Full error report written to %s\n", path)
+	}
+}
@@ -0,0 +1,86 @@
+package eta
+
+import (
+	"complete_run/clock"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock used for the reporting interval and the ETA; swappable for deterministic timing
+var clk = clock.Real
+
+// Reporter periodically prints how many of total items are done, e.g.
+// "Completed 340/2000 (17%), ~4m remaining". A nil Reporter does nothing, so
+// callers need not check whether progress reporting is on.
+type Reporter struct {
+	w       io.Writer
+	verb    string
+	total   int // 0 when unknown; only the count is printed then
+	done    atomic.Int64
+	started time.Time
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Start prints progress to w every interval until Stop. It returns nil when
+// interval is not positive.
+func Start(w io.Writer, verb string, total int, interval time.Duration) *Reporter {
+	if interval <= 0 {
+		return nil
+	}
+	r := &Reporter{w: w, verb: verb, total: total, started: clk.Now(), stop: make(chan struct{})}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := clk.Tick(interval)
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker:
+				r.print()
+			}
+		}
+	}()
+	return r
+}
+
+// Add counts n more items as done
+func (r *Reporter) Add(n int) {
+	if r != nil {
+		r.done.Add(int64(n))
+	}
+}
+
+// Stop ends the reporting. No line is printed afterwards, so the caller's
+// summary is the last word.
+func (r *Reporter) Stop() {
+	if r == nil {
+		return
+	}
+	close(r.stop)
+	r.wg.Wait()
+}
+
+func (r *Reporter) print() {
+	fmt.Fprintln(r.w, r.line())
+}
+
+// line formats one progress line. The ETA assumes the remaining items take as
+// long on average as the ones done so far.
+func (r *Reporter) line() string {
+	done := int(r.done.Load())
+	if r.total <= 0 {
+		return fmt.Sprintf("%s %d", r.verb, done)
+	}
+	line := fmt.Sprintf("%s %d/%d (%d%%)", r.verb, done, r.total, done*100/r.total)
+	if done > 0 && done < r.total {
+		elapsed := clk.Now().Sub(r.started)
+		remaining := time.Duration(float64(elapsed) / float64(done) * float64(r.total-done))
+		line += fmt.Sprintf(", ~%v remaining", remaining.Round(time.Second))
+	}
+	return line
+}
@@ -0,0 +1,47 @@
+package eta
+
+import (
+	"complete_run/clock"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestLine(t *testing.T) {
+	fake := clock.NewFake(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	defer func(c clock.Clock) { clk = c }(clk)
+	clk = fake
+
+	tests := []struct {
+		name    string
+		total   int
+		done    int
+		elapsed time.Duration
+		want    string
+	}{
+		{"nothing done has no ETA", 100, 0, time.Minute, "Completed 0/100 (0%)"},
+		{"remaining at the average pace", 100, 25, time.Minute, "Completed 25/100 (25%), ~3m0s remaining"},
+		{"rounded to seconds", 3, 1, 1500 * time.Millisecond, "Completed 1/3 (33%), ~3s remaining"},
+		{"all done has no ETA", 10, 10, time.Minute, "Completed 10/10 (100%)"},
+		{"unknown total prints the count", 0, 7, time.Minute, "Completed 7"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &Reporter{verb: "Completed", total: test.total, started: fake.Now()}
+			r.Add(test.done)
+			fake.Advance(test.elapsed)
+			if got := r.line(); got != test.want {
+				t.Errorf("line() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNilReporter(t *testing.T) {
+	r := Start(io.Discard, "Completed", 10, 0)
+	if r != nil {
+		t.Fatal("Start with no interval should return nil")
+	}
+	r.Add(1) // Must not panic
+	r.Stop()
+}
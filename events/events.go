@@ -0,0 +1,76 @@
+package events
+
+import (
+	"complete_run/clock"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	out io.Writer
+	mu  sync.Mutex
+	clk = clock.Real
+)
+
+// Completion describes the outcome of one completion attempt
+type Completion struct {
+	RunID      int
+	Success    bool
+	HTTPStatus int    // 0 when no response was received
+	Attempts   int    // Requests sent, retries included
+	RunStatus  *int   // Run status returned by the server, if it returned the run
+	EndTime    string // Run end time returned by the server, if any
+}
+
+// completionEvent is the line written for a Completion
+type completionEvent struct {
+	TS         string `json:"ts"`
+	RunID      int    `json:"run_id"`
+	Outcome    string `json:"outcome"`
+	HTTPStatus int    `json:"http_status"`
+	Attempts   int    `json:"attempts"`
+	RunStatus  *int   `json:"run_status,omitempty"`
+	EndTime    string `json:"end_time,omitempty"`
+}
+
+// Enable turns on the event stream, one JSON object per line written to w.
+// Run IDs are written as is, like in the output files, even with --redact.
+func Enable(w io.Writer) {
+	out = w
+}
+
+// Completed records the outcome of a completion attempt. It returns an error
+// if the event could not be written.
+func Completed(c Completion) error {
+	if out == nil {
+		return nil
+	}
+
+	event := completionEvent{
+		TS:         clk.Now().UTC().Format(time.RFC3339Nano),
+		RunID:      c.RunID,
+		Outcome:    "failed",
+		HTTPStatus: c.HTTPStatus,
+		Attempts:   c.Attempts,
+		RunStatus:  c.RunStatus,
+		EndTime:    c.EndTime,
+	}
+	if c.Success {
+		event.Outcome = "completed"
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("encoding event: %v", err)
+	}
+
+	// Lines from concurrent completions must not interleave
+	mu.Lock()
+	defer mu.Unlock()
+	if _, err := out.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("writing event: %v", err)
+	}
+	return nil
+}
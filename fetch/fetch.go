@@ -1,145 +1,644 @@
 package fetch
 
 import (
+	"bytes"
+	"complete_run/clock"
+	"complete_run/config"
+	"complete_run/errreport"
+	"complete_run/qase"
+	"complete_run/resultsfile"
+	"complete_run/setup"
+	"complete_run/stdio"
+	"complete_run/transport"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
-const limit = 100             // Number of results per request
-const maxParallelRequests = 6 // Max parallel requests per second
-
-var (
-	apiToken    = os.Getenv("QASE_API_TOKEN")
-	projectCode = os.Getenv("QASE_PROJECT_CODE")
-	outputFile  = "results.json"
-	client      = &http.Client{}
-	mutex       = &sync.Mutex{}
-	wg          sync.WaitGroup
-	rateLimiter = time.Tick(time.Second / maxParallelRequests) // Rate limiting mechanism
+const PageSize = 100 // Number of results per request
+
+// Request rate and number of page workers unless --rps/--concurrency are set
+const (
+	DefaultRPS     = 6
+	defaultWorkers = 6
 )
 
-type APIResponse struct {
-	Status bool `json:"status"`
-	Result struct {
-		Total    int                      `json:"total"`
-		Filtered int                      `json:"filtered"`
-		Count    int                      `json:"count"`
-		Entities []map[string]interface{} `json:"entities"`
-	} `json:"result"`
+// Clock used for rate limiting; swappable for deterministic timing
+var clk = clock.Real
+
+// Fetcher fetches the result list for one configuration. The state of a fetch
+// lives in the Fetcher and is reset when the next one starts, so a Fetcher
+// runs one fetch at a time.
+type Fetcher struct {
+	cfg  *config.Config
+	api  *qase.Client
+	log  io.Writer
+	errs errreport.Logger
+
+	outputFile  string     // cfg.ResultsFile plus ".partial" while fetchAll runs
+	mutex       sync.Mutex // Guards the output file, seenHashes and report
+	rateLimiter <-chan time.Time
+	workers     int // Page workers per query
+	seenHashes  map[string]bool
+	report      Report
+	ran         bool        // A fetch started, so report describes it
+	inFlight    *byteBudget // Bounded by --max-in-flight-bytes
 }
 
-func fetchResults(offset int, resultsChan chan<- []map[string]interface{}) {
-	defer wg.Done()
-	<-rateLimiter // Enforce rate limiting
+// New returns a Fetcher sending its requests through api and writing its log
+// lines to log. It applies the process-wide settings of cfg with setup.Apply.
+func New(cfg *config.Config, api *qase.Client, log io.Writer) *Fetcher {
+	setup.Apply(cfg)
+	return &Fetcher{cfg: cfg, api: api.WithLog(log), log: log, errs: errreport.To(log)}
+}
 
-	url := fmt.Sprintf("https://api.qase.io/v1/result/%s?limit=%d&offset=%d", projectCode, limit, offset)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		fmt.Println("Error creating request:", err)
-		return
+// page is one fetched page of results with the size of the response it came
+// from, which is held against the in-flight budget until the page is written
+type page struct {
+	entities []map[string]interface{}
+	size     int64
+}
+
+// byteBudget bounds the approximate memory held by fetched pages that are not
+// written yet. A new fetch starts only while usage is below max, so usage
+// stays under max plus one page per worker. A max of 0 is unlimited.
+type byteBudget struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	max  int64
+	used int64
+}
+
+func newByteBudget(max int64) *byteBudget {
+	b := &byteBudget{max: max}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// wait blocks until usage is below max
+func (b *byteBudget) wait() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.max > 0 && b.used >= b.max {
+		b.cond.Wait()
 	}
-	req.Header.Add("accept", "application/json")
-	req.Header.Add("Token", apiToken)
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println("Request error:", err)
-		return
+func (b *byteBudget) add(n int64) {
+	b.mu.Lock()
+	b.used += n
+	b.mu.Unlock()
+}
+
+func (b *byteBudget) release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// Report summarizes a fetch so an orchestrator can check it was complete
+// before trusting the downstream stages
+type Report struct {
+	TotalExpected    int     `json:"total_expected"`
+	TotalWritten     int     `json:"total_written"`
+	BytesWritten     int64   `json:"bytes_written"`
+	PagesFetched     int     `json:"pages_fetched"`
+	PagesFailed      int     `json:"pages_failed"`
+	ResultsMissed    int     `json:"results_missed"` // Results on failed pages
+	Duplicates       int     `json:"duplicates"`
+	PartitionsFailed int     `json:"partitions_failed,omitempty"`
+	WriteFailed      int     `json:"write_failed,omitempty"` // Results that could not be written to the output file
+	DurationSeconds  float64 `json:"duration_seconds"`
+	Complete         bool    `json:"complete"`
+}
+
+// Report returns the summary of the last fetch, the one --fetch-report writes,
+// or nil if none ran. A fetch that failed early is reported incomplete.
+func (f *Fetcher) Report() *Report {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !f.ran {
+		return nil
+	}
+	report := f.report
+	return &report
+}
+
+// fetchWorker fetches pages for offsets until the offsets channel is closed.
+// Sending to a full resultsChan blocks the worker, so it stops pulling new
+// offsets while the writer is behind. total is the size of the listing, to
+// count the results on failed pages.
+func (f *Fetcher) fetchWorker(ctx context.Context, query string, total int, offsets <-chan int, resultsChan chan<- page) {
+	for offset := range offsets {
+		ok := f.fetchResults(ctx, query, offset, resultsChan)
+
+		f.mutex.Lock()
+		if ok {
+			f.report.PagesFetched++
+		} else {
+			f.report.PagesFailed++
+			f.report.ResultsMissed += min(PageSize, total-offset)
+		}
+		f.mutex.Unlock()
 	}
-	defer resp.Body.Close()
+}
+
+// fetchResults fetches one page of results. query holds extra URL parameters
+// (starting with &) appended to the result-list URL.
+func (f *Fetcher) fetchResults(ctx context.Context, query string, offset int, resultsChan chan<- page) bool {
+	f.inFlight.wait() // Wait until earlier pages are written if memory is capped
+	<-f.rateLimiter   // Enforce rate limiting
 
-	body, err := io.ReadAll(resp.Body)
+	results, err := f.api.GetResults(ctx, f.cfg.ProjectCode, PageSize, offset, query)
 	if err != nil {
-		fmt.Println("Error reading response:", err)
-		return
+		f.errs.Errorf("fetch", fmt.Sprintf("offset=%d", offset), "Error fetching results at offset %d: %v", offset, err)
+		return false
 	}
 
-	var apiResp APIResponse
-	if err := json.Unmarshal(body, &apiResp); err != nil {
-		fmt.Println("Error parsing JSON:", err)
-		return
+	// The decoded page is held until the writer has saved it
+	f.inFlight.add(results.Size)
+	resultsChan <- page{entities: results.Entities, size: results.Size}
+	return true
+}
+
+// saveResultsToFile appends results to the output file, one JSON object per
+// line, skipping results whose hash was already written. When stream is non-nil
+// every written line is also sent to it. It returns false once writing another
+// line would exceed --max-results-bytes.
+func (f *Fetcher) saveResultsToFile(results []map[string]interface{}, stream chan<- []byte) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// With --in-memory lines only go to stream; nothing touches the disk
+	var out io.Writer = io.Discard
+	if !f.cfg.InMemory {
+		file, err := stdio.Append(f.outputFile)
+		if err != nil {
+			f.errs.Errorf("fetch", "", "Error opening file: %v", err)
+			f.report.WriteFailed += len(results)
+			return true
+		}
+		defer file.Close()
+		out = file
+
+		// Each batch becomes its own gzip member; readers handle concatenated members
+		if f.cfg.CompressOutput {
+			zw := gzip.NewWriter(file)
+			defer zw.Close()
+			out = zw
+		}
 	}
 
-	if !apiResp.Status {
-		fmt.Println("API response status is false")
-		return
+	for _, result := range results {
+		if hash, _ := result["hash"].(string); hash != "" {
+			if f.seenHashes[hash] {
+				f.report.Duplicates++
+				continue
+			}
+			f.seenHashes[hash] = true
+		}
+
+		line, err := json.Marshal(result)
+		if err != nil {
+			f.errs.Errorf("fetch", "", "Error writing to file: %v", err)
+			f.report.WriteFailed++
+			continue
+		}
+		maxResultsBytes := int64(f.cfg.MaxResultsBytes)
+		if maxResultsBytes > 0 && f.report.BytesWritten+int64(len(line))+1 > maxResultsBytes {
+			return false
+		}
+		n, err := out.Write(append(line, '\n'))
+		f.report.BytesWritten += int64(n)
+		if err != nil {
+			f.errs.Errorf("fetch", "", "Error writing to file: %v", err)
+			f.report.WriteFailed++
+			continue
+		}
+		f.report.TotalWritten++
+		if stream != nil {
+			stream <- line
+		}
 	}
+	return true
+}
 
-	resultsChan <- apiResp.Result.Entities
+// Fetch fetches every result and writes them to the results file
+func (f *Fetcher) Fetch(ctx context.Context) error {
+	return f.fetchAll(ctx, nil)
 }
 
-func saveResultsToFile(results []map[string]interface{}) {
-	mutex.Lock()
-	defer mutex.Unlock()
+// FetchStreaming behaves like Fetch but also sends every result line to stream
+// as soon as it is written, closing stream when fetching ends. This lets a
+// consumer work on results while the fetch is still in progress.
+func (f *Fetcher) FetchStreaming(ctx context.Context, stream chan<- []byte) error {
+	defer close(stream)
+	return f.fetchAll(ctx, stream)
+}
 
-	file, err := os.OpenFile(outputFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		fmt.Println("Error opening file:", err)
-		return
+// FetchInMemory fetches results like Fetch but keeps the result lines in
+// memory instead of writing results.json, for --in-memory
+func (f *Fetcher) FetchInMemory(ctx context.Context) ([][]byte, error) {
+	stream := make(chan []byte, 1000)
+	done := make(chan struct{})
+	var lines [][]byte
+	go func() {
+		for line := range stream {
+			lines = append(lines, line)
+		}
+		close(done)
+	}()
+
+	err := f.fetchAll(ctx, stream)
+	close(stream)
+	<-done
+	return lines, err
+}
+
+// resultQuery builds the extra result-list URL parameters from cfg
+func resultQuery(cfg *config.Config) string {
+	var query string
+	if len(cfg.FetchRunIDs) > 0 {
+		runs := make([]string, len(cfg.FetchRunIDs))
+		for i, id := range cfg.FetchRunIDs {
+			runs[i] = strconv.Itoa(id)
+		}
+		query += "&run=" + url.QueryEscape(strings.Join(runs, ","))
 	}
-	defer file.Close()
+	for _, param := range cfg.FetchParams {
+		key, value, _ := config.ParseQueryParam(param) // Checked by Validate
+		query += "&" + url.QueryEscape(key) + "=" + url.QueryEscape(value)
+	}
+	return query
+}
 
-	encoder := json.NewEncoder(file)
-	for _, result := range results {
-		if err := encoder.Encode(result); err != nil {
-			fmt.Println("Error writing to file:", err)
+// Layout of the from_end_time/to_end_time filters
+const partitionTimeLayout = "2006-01-02 15:04:05"
+
+// partitionQueries splits the fetch into end-time windows of cfg.FetchPartition
+// between --fetch-from and --fetch-to (default now), so no single listing has
+// to page past the API's offset ceiling. Without a partition it returns the
+// plain result query.
+func partitionQueries(cfg *config.Config) []string {
+	base := resultQuery(cfg)
+	if cfg.FetchPartition == "" {
+		return []string{base}
+	}
+
+	to := cfg.FetchTo
+	if to.IsZero() {
+		to = clk.Now()
+	}
+	var queries []string
+	for from := cfg.FetchFrom; from.Before(to); {
+		next := nextPartition(from, cfg.FetchPartition)
+		if next.After(to) {
+			next = to
 		}
+		// Windows share their boundary second; results on it are deduplicated by hash
+		queries = append(queries, base+
+			"&from_end_time="+url.QueryEscape(from.UTC().Format(partitionTimeLayout))+
+			"&to_end_time="+url.QueryEscape(next.UTC().Format(partitionTimeLayout)))
+		from = next
 	}
+	return queries
 }
 
-func FetchResults() {
-	if apiToken == "" || projectCode == "" {
-		fmt.Println("Missing required environment variables: QASE_API_TOKEN and QASE_PROJECT_CODE")
-		return
+func nextPartition(t time.Time, partition string) time.Time {
+	switch partition {
+	case "day":
+		return t.AddDate(0, 0, 1)
+	case "week":
+		return t.AddDate(0, 0, 7)
+	case "year":
+		return t.AddDate(1, 0, 0)
+	default:
+		return t.AddDate(0, 1, 0)
+	}
+}
+
+func (f *Fetcher) fetchAll(ctx context.Context, stream chan<- []byte) error {
+	cfg := f.cfg
+	if cfg.APIToken == "" || cfg.ProjectCode == "" {
+		return errors.New("missing required environment variables: QASE_API_TOKEN and QASE_PROJECT_CODE")
+	}
+	defer f.api.CloseIdle() // Release keep-alive sockets before the next stage
+
+	started := clk.Now()
+	resultsFile := cfg.ResultsFile()
+	// Results are written next to the results file and only renamed into place
+	// once the fetch succeeded, so a failed fetch never leaves a half-written
+	// or stale results file behind for filter and match. Stdout cannot be
+	// renamed; results are written to it as they arrive.
+	toStdout := resultsFile == stdio.Name
+	f.outputFile = resultsFile + ".partial"
+	if toStdout {
+		f.outputFile = stdio.Name
+	}
+	if !cfg.InMemory && !toStdout {
+		if err := os.Remove(resultsFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("removing previous results: %v", err)
+		}
+		if err := os.WriteFile(f.outputFile, nil, 0644); err != nil {
+			return fmt.Errorf("creating results file: %v", err)
+		}
 	}
+	f.rateLimiter = clk.Tick(time.Second / time.Duration(cfg.StageRPS(DefaultRPS)))
+	f.workers = cfg.StageConcurrency(defaultWorkers)
+	transport.UseLimits(cfg.StageRPS(DefaultRPS), f.workers)
+	f.seenHashes = make(map[string]bool)
+	f.report = Report{}
+	f.ran = true
+	f.inFlight = newByteBudget(int64(cfg.MaxInFlightBytes))
 
-	// Fetch initial result to get total count
-	url := fmt.Sprintf("https://api.qase.io/v1/result/%s?limit=1&offset=0", projectCode)
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Add("accept", "application/json")
-	req.Header.Add("Token", apiToken)
+	ctx, cancel := cfg.StageContext(ctx, cfg.FetchTimeout)
+	defer cancel()
 
-	res, err := client.Do(req)
+	limitExceeded := false
+	queries := partitionQueries(cfg)
+	for i, query := range queries {
+		if ctx.Err() != nil {
+			break
+		}
+		if len(queries) > 1 {
+			fmt.Fprintf(f.log, "Fetching partition %d/%d\n", i+1, len(queries))
+		}
+		err := f.fetchQuery(ctx, query, stream)
+		if errors.Is(err, errResultsLimit) {
+			limitExceeded = true
+			break
+		}
+		if err != nil {
+			// Without partitions there is nothing to report on; with them the
+			// other partitions are still worth fetching, unless the token was
+			// rejected
+			if len(queries) == 1 || errors.Is(err, transport.ErrUnauthorized) {
+				return fmt.Errorf("fetching results: %w", err)
+			}
+			f.errs.Errorf("fetch", fmt.Sprintf("partition=%d", i+1), "Error fetching results: %v", err)
+			f.report.PartitionsFailed++
+		}
+	}
+
+	timedOut := ctx.Err() != nil
+	if !limitExceeded && !timedOut && cfg.InMemory {
+		fmt.Fprintf(f.log, "Fetching complete. Kept %d results in memory\n", f.report.TotalWritten)
+	}
+
+	verified := true
+	if cfg.VerifyResults && !limitExceeded && !timedOut {
+		verified = f.verifyResults()
+	}
+
+	report := &f.report
+	report.DurationSeconds = clk.Now().Sub(started).Seconds()
+	report.Complete = verified && !limitExceeded && !timedOut && report.PagesFailed == 0 && report.PartitionsFailed == 0 && report.WriteFailed == 0 &&
+		report.TotalWritten+report.Duplicates >= report.TotalExpected
+	if cfg.FetchReport != "" {
+		if err := writeFetchReport(cfg.FetchReport, *report, cfg.Pretty); err != nil {
+			return fmt.Errorf("writing fetch report: %v", err)
+		}
+	}
+
+	// Filtering incomplete results could select a run whose failing result was
+	// never fetched, so any gap fails the stage
+	switch {
+	case limitExceeded:
+		return fmt.Errorf("%s reached the --max-results-bytes limit of %d bytes; fetch aborted with incomplete results",
+			f.outputFile, cfg.MaxResultsBytes)
+	case timedOut:
+		return fmt.Errorf("fetch %s; results are incomplete", config.StopReason(ctx))
+	case !verified:
+		return errors.New("results verification failed")
+	case report.PagesFailed > 0 || report.PartitionsFailed > 0:
+		return fmt.Errorf("%d pages and %d partitions failed; results are incomplete", report.PagesFailed, report.PartitionsFailed)
+	case report.WriteFailed > 0:
+		return fmt.Errorf("%d results could not be written to %s; results are incomplete", report.WriteFailed, f.outputFile)
+	}
+
+	if !cfg.InMemory && !toStdout {
+		if err := os.Rename(f.outputFile, resultsFile); err != nil {
+			return fmt.Errorf("saving results: %v", err)
+		}
+		fmt.Fprintln(f.log, "Fetching complete. Results saved to", resultsFile)
+	}
+	return nil
+}
+
+// fetchTotal requests a single result to learn how many results query matches.
+// known is false when the response carries no total, e.g. a bare array; the
+// pages can then only be fetched one after another until a short one.
+func (f *Fetcher) fetchTotal(ctx context.Context, query string) (total int, known bool, err error) {
+	initial, err := f.api.GetResults(ctx, f.cfg.ProjectCode, 1, 0, query)
 	if err != nil {
-		fmt.Println("Error making initial request:", err)
-		return
+		return 0, false, fmt.Errorf("initial request: %w", err)
+	}
+	return initial.Total, initial.HasTotal, nil
+}
+
+// EstimateRequests returns how many result-list requests a fetch would make,
+// retries aside. It costs one request per partition.
+func (f *Fetcher) EstimateRequests() (int, error) {
+	requests := 0
+	for _, query := range partitionQueries(f.cfg) {
+		total, known, err := f.fetchTotal(context.Background(), query)
+		if err != nil {
+			return 0, err
+		}
+		if !known {
+			return 0, errors.New("the API reports no total result count, so the number of pages is unknown")
+		}
+		requests += 1 + (total+PageSize-1)/PageSize // The initial request plus one per page
 	}
-	defer res.Body.Close()
+	return requests, nil
+}
 
-	body, _ := io.ReadAll(res.Body)
+// errResultsLimit reports that the output reached --max-results-bytes
+var errResultsLimit = errors.New("results size limit reached")
 
-	var initialResp APIResponse
-	if err := json.Unmarshal(body, &initialResp); err != nil {
-		fmt.Println("Error parsing initial response:", err)
-		return
+// fetchQuery fetches every page of the result list narrowed by query. No new
+// pages are requested once ctx is done.
+func (f *Fetcher) fetchQuery(ctx context.Context, query string, stream chan<- []byte) error {
+	totalResults, known, err := f.fetchTotal(ctx, query)
+	if err != nil {
+		return err
+	}
+	if !known {
+		fmt.Fprintln(f.log, "The API reported no total result count; fetching pages one by one until a short page")
+		return f.fetchUntilShortPage(ctx, query, stream)
 	}
 
-	totalResults := initialResp.Result.Total
-	fmt.Println("Total results to fetch:", totalResults)
+	f.mutex.Lock()
+	f.report.TotalExpected += totalResults
+	f.mutex.Unlock()
+	fmt.Fprintln(f.log, "Total results to fetch:", totalResults)
 
-	resultsChan := make(chan []map[string]interface{}, maxParallelRequests)
+	// Memory stays bounded by a fixed pool of workers and a fixed channel buffer:
+	// at most 2*workers pages are held while the writer catches up.
+	offsets := make(chan int)
+	resultsChan := make(chan page, f.workers)
 
 	// Launch workers to fetch data in parallel
-	for offset := 0; offset < totalResults; offset += limit {
+	var wg sync.WaitGroup
+	for i := 0; i < f.workers; i++ {
 		wg.Add(1)
-		go fetchResults(offset, resultsChan)
+		go func() {
+			defer wg.Done()
+			f.fetchWorker(ctx, query, totalResults, offsets, resultsChan)
+		}()
 	}
 
+	// Closed when the output grows past --max-results-bytes, to stop handing out offsets
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(offsets)
+		for offset := 0; offset < totalResults; offset += PageSize {
+			select {
+			case offsets <- offset:
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
 	// Close channel when all fetches are done
 	go func() {
 		wg.Wait()
 		close(resultsChan)
 	}()
 
-	// Collect results and write to file
+	// Collect results and write to file. Once the size cap is hit, keep draining
+	// so in-flight workers can finish, but write nothing more.
+	limitExceeded := false
 	for results := range resultsChan {
-		saveResultsToFile(results)
+		if !limitExceeded && !f.saveResultsToFile(results.entities, stream) {
+			limitExceeded = true
+			close(stop)
+		}
+		f.inFlight.release(results.size)
 	}
+	if limitExceeded {
+		return errResultsLimit
+	}
+	return nil
+}
+
+// fetchUntilShortPage fetches the pages of query one after another until one
+// holds fewer than PageSize results, for responses without a total. Every result
+// seen is expected, so a failed page fails the query: how many results it
+// held is unknown.
+func (f *Fetcher) fetchUntilShortPage(ctx context.Context, query string, stream chan<- []byte) error {
+	for offset := 0; ; offset += PageSize {
+		select {
+		case <-ctx.Done():
+			return nil // Reported as a stopped fetch by fetchAll
+		case <-f.rateLimiter:
+		}
+
+		results, err := f.api.GetResults(ctx, f.cfg.ProjectCode, PageSize, offset, query)
+		if err != nil {
+			f.mutex.Lock()
+			f.report.PagesFailed++
+			f.mutex.Unlock()
+			return fmt.Errorf("fetching results at offset %d: %w", offset, err)
+		}
+
+		f.mutex.Lock()
+		f.report.PagesFetched++
+		f.report.TotalExpected += len(results.Entities)
+		f.mutex.Unlock()
+		if !f.saveResultsToFile(results.Entities, stream) {
+			return errResultsLimit
+		}
+		if len(results.Entities) < PageSize {
+			fmt.Fprintln(f.log, "Total results fetched:", offset+len(results.Entities))
+			return nil
+		}
+	}
+}
+
+// verifyResults checks that every result the listing reported was accounted
+// for, and that the output file holds exactly the lines fetch wrote, to catch
+// write failures that were only logged. It reports each mismatch as an error.
+func (f *Fetcher) verifyResults() bool {
+	report := &f.report
+	ok := true
+	accounted := report.TotalWritten + report.Duplicates + report.ResultsMissed
+	if accounted != report.TotalExpected {
+		f.errs.Errorf("fetch", "", "Error: verification failed: expected %d results, accounted for %d (%d written, %d duplicates, %d on failed pages)",
+			report.TotalExpected, accounted, report.TotalWritten, report.Duplicates, report.ResultsMissed)
+		ok = false
+	}
+	// Neither memory nor stdout can be read back
+	if f.cfg.InMemory || f.outputFile == stdio.Name {
+		return ok
+	}
+
+	lines, err := countLines(f.outputFile)
+	if err != nil {
+		f.errs.Errorf("fetch", "", "Error: verification failed: cannot read %s back: %v", f.outputFile, err)
+		return false
+	}
+	if lines != report.TotalWritten {
+		f.errs.Errorf("fetch", "", "Error: verification failed: %s has %d lines but %d results were written",
+			f.outputFile, lines, report.TotalWritten)
+		return false
+	}
+	if ok {
+		fmt.Fprintf(f.log, "Verified %s: %d lines\n", f.outputFile, lines)
+	}
+	return ok
+}
+
+// countLines counts the newline-terminated lines of a results file
+func countLines(name string) (int, error) {
+	file, err := resultsfile.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
 
-	fmt.Println("Fetching complete. Results saved to", outputFile)
+	lines := 0
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := file.Read(buf)
+		lines += bytes.Count(buf[:n], []byte{'\n'})
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+	}
+}
+
+// writeFetchReport writes the fetch summary as JSON to path, or stdout for "-".
+// It is a single line unless pretty is set, for --pretty.
+func writeFetchReport(path string, report Report, pretty bool) error {
+	var data []byte
+	var err error
+	if pretty {
+		data, err = json.MarshalIndent(report, "", "  ")
+	} else {
+		data, err = json.Marshal(report)
+	}
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	return stdio.WriteFile(path, data)
 }
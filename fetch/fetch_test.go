@@ -0,0 +1,270 @@
+package fetch
+
+import (
+	"complete_run/config"
+	"complete_run/qase"
+	"complete_run/retry"
+	"complete_run/transport"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testFetcher returns a Fetcher for an in-memory fetch from handler, sending
+// requests without pacing and retrying without waiting
+func testFetcher(t *testing.T, handler http.HandlerFunc) *Fetcher {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	cfg, err := config.Defaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.APIToken, cfg.ProjectCode = "token", "DEMO"
+	cfg.InMemory = true
+	cfg.RPS = 1000
+
+	f := New(cfg, qase.New(srv.URL, "token", srv.Client()), io.Discard)
+	reads := retry.Reads
+	retry.Reads.InitialDelay, retry.Reads.MaxDelay = time.Millisecond, time.Millisecond
+	t.Cleanup(func() { retry.Reads = reads })
+	return f
+}
+
+func TestFetchRetriesFailedPages(t *testing.T) {
+	for _, status := range []int{http.StatusInternalServerError, http.StatusBadGateway} {
+		var requests atomic.Int32
+		f := testFetcher(t, func(w http.ResponseWriter, r *http.Request) {
+			// The total request succeeds; the page request fails once
+			if requests.Add(1) == 2 {
+				w.WriteHeader(status)
+				return
+			}
+			io.WriteString(w, `{"status":true,"result":{"total":2,"entities":[{"id":1},{"id":2}]}}`)
+		})
+
+		lines, err := f.FetchInMemory(context.Background())
+		if err != nil {
+			t.Fatalf("HTTP %d: FetchInMemory failed: %v", status, err)
+		}
+		if len(lines) != 2 || requests.Load() != 3 {
+			t.Errorf("HTTP %d: got %d results after %d requests, want 2 after 3", status, len(lines), requests.Load())
+		}
+		if f.report.PagesFailed != 0 || f.report.PagesFetched != 1 {
+			t.Errorf("HTTP %d: report: %d pages fetched, %d failed; want 1 and 0", status, f.report.PagesFetched, f.report.PagesFailed)
+		}
+	}
+}
+
+func TestFetchAbortsOnRejectedToken(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		var requests atomic.Int32
+		f := testFetcher(t, func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.WriteHeader(status)
+		})
+
+		lines, err := f.FetchInMemory(context.Background())
+		if !errors.Is(err, transport.ErrUnauthorized) {
+			t.Errorf("HTTP %d: err = %v, want ErrUnauthorized", status, err)
+		}
+		if len(lines) != 0 || requests.Load() != 1 {
+			t.Errorf("HTTP %d: got %d results after %d requests, want none after 1", status, len(lines), requests.Load())
+		}
+	}
+}
+
+// resultServer serves a result list of total results, each with a distinct
+// hash, honoring limit and offset. wrapped answers in the documented shape
+// with a total; otherwise pages are bare arrays without one. Every request is
+// counted in requests.
+func resultServer(total int, wrapped bool, requests *atomic.Int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		entities := []map[string]interface{}{}
+		for i := offset; i < min(offset+limit, total); i++ {
+			entities = append(entities, map[string]interface{}{"id": i, "hash": fmt.Sprintf("h%d", i), "run_id": 1})
+		}
+		var body interface{} = entities
+		if wrapped {
+			body = map[string]interface{}{"status": true, "result": map[string]interface{}{"total": total, "entities": entities}}
+		}
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+// distinctResults returns how many different results lines hold
+func distinctResults(t *testing.T, lines [][]byte) int {
+	t.Helper()
+	ids := make(map[float64]bool)
+	for _, line := range lines {
+		var result map[string]interface{}
+		if err := json.Unmarshal(line, &result); err != nil {
+			t.Fatalf("bad result line %s: %v", line, err)
+		}
+		ids[result["id"].(float64)] = true
+	}
+	return len(ids)
+}
+
+func TestFetchPages(t *testing.T) {
+	tests := []struct {
+		name     string
+		total    int
+		wrapped  bool
+		requests int32 // The total request plus the pages
+	}{
+		{"exactly one page", PageSize, true, 1 + 1},
+		{"one past a page", PageSize + 1, true, 1 + 2},
+		{"short final page", 2*PageSize + 50, true, 1 + 3},
+		{"no results", 0, true, 1},
+		{"bare arrays until a short page", 2*PageSize + 50, false, 1 + 3},
+		{"bare arrays ending on an empty page", 2 * PageSize, false, 1 + 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requests atomic.Int32
+			f := testFetcher(t, resultServer(test.total, test.wrapped, &requests))
+
+			lines, err := f.FetchInMemory(context.Background())
+			if err != nil {
+				t.Fatalf("FetchInMemory failed: %v", err)
+			}
+			if len(lines) != test.total || distinctResults(t, lines) != test.total {
+				t.Errorf("got %d results, %d distinct; want %d", len(lines), distinctResults(t, lines), test.total)
+			}
+			if requests.Load() != test.requests {
+				t.Errorf("%d requests, want %d", requests.Load(), test.requests)
+			}
+			if report := f.Report(); !report.Complete || report.PagesFailed != 0 {
+				t.Errorf("report: complete %v, %d pages failed", report.Complete, report.PagesFailed)
+			}
+		})
+	}
+}
+
+func TestFetchDeduplicatesAcrossPartitions(t *testing.T) {
+	var requests atomic.Int32
+	// Both partitions list the same results, as on a shared boundary second
+	f := testFetcher(t, resultServer(PageSize+10, true, &requests))
+	f.cfg.FetchPartition = "day"
+	f.cfg.FetchFrom = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	f.cfg.FetchTo = f.cfg.FetchFrom.AddDate(0, 0, 2)
+
+	lines, err := f.FetchInMemory(context.Background())
+	if err != nil {
+		t.Fatalf("FetchInMemory failed: %v", err)
+	}
+	if len(lines) != PageSize+10 {
+		t.Errorf("got %d results, want %d: the second partition only repeats the first", len(lines), PageSize+10)
+	}
+	if report := f.Report(); report.Duplicates != PageSize+10 || !report.Complete {
+		t.Errorf("report: %d duplicates, complete %v; want %d and true", report.Duplicates, report.Complete, PageSize+10)
+	}
+	if requests.Load() != 2*(1+2) {
+		t.Errorf("%d requests, want %d", requests.Load(), 2*(1+2))
+	}
+}
+
+func TestFetchReplacesPreviousResults(t *testing.T) {
+	resultsFile := filepath.Join(t.TempDir(), "results.json")
+	if err := os.WriteFile(resultsFile, []byte(`{"id":99,"hash":"stale","run_id":1}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first fetch finds 5 results, the second only 2
+	for _, total := range []int{5, 2} {
+		var requests atomic.Int32
+		f := testFetcher(t, resultServer(total, true, &requests))
+		f.cfg.InMemory = false
+		f.cfg.ResultsPath = resultsFile
+		if err := f.Fetch(context.Background()); err != nil {
+			t.Fatalf("fetch of %d results failed: %v", total, err)
+		}
+	}
+
+	content, err := os.ReadFile(resultsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines [][]byte
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		lines = append(lines, []byte(line))
+	}
+	if len(lines) != 2 || distinctResults(t, lines) != 2 || strings.Contains(string(content), "stale") {
+		t.Errorf("results file holds %d lines, want only the 2 of the second fetch:\n%s", len(lines), content)
+	}
+	if _, err := os.Stat(resultsFile + ".partial"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the partial file was left behind: %v", err)
+	}
+}
+
+func TestFetchBoundsPagesAheadOfASlowWriter(t *testing.T) {
+	const workers, pages = 2, 20
+	tests := []struct {
+		name          string
+		maxInFlight   int
+		maxPagesAhead int64 // Pages requested but not yet consumed, the one being requested included
+	}{
+		// Each worker holds a page it cannot hand over, the channel buffers one
+		// per worker and the writer holds one
+		{"channel backpressure", 0, 2*workers + 1 + 1},
+		// Requests wait while any page is unwritten, so each worker holds at most one
+		{"in-flight budget", 1, workers + 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requests atomic.Int32
+			var consumed atomic.Int64
+			var mu sync.Mutex
+			var requested, maxAhead int64
+			results := resultServer(pages*PageSize, true, &requests)
+			f := testFetcher(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("limit") == strconv.Itoa(PageSize) {
+					mu.Lock()
+					requested++
+					maxAhead = max(maxAhead, requested-consumed.Load()/PageSize)
+					mu.Unlock()
+				}
+				results(w, r)
+			})
+			f.cfg.Concurrency = workers
+			f.cfg.MaxInFlightBytes = test.maxInFlight
+
+			// The consumer is the bottleneck: every quarter page takes a while
+			stream := make(chan []byte)
+			done := make(chan error)
+			go func() { done <- f.FetchStreaming(context.Background(), stream) }()
+			for range stream {
+				if consumed.Add(1)%(PageSize/4) == 0 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			if err := <-done; err != nil {
+				t.Fatalf("FetchStreaming failed: %v", err)
+			}
+
+			if consumed.Load() != pages*PageSize {
+				t.Errorf("consumed %d results, want %d", consumed.Load(), pages*PageSize)
+			}
+			if maxAhead > test.maxPagesAhead {
+				t.Errorf("up to %d pages requested ahead of the writer, want at most %d", maxAhead, test.maxPagesAhead)
+			}
+		})
+	}
+}
@@ -1,140 +1,406 @@
 package filter
 
 import (
-	"bufio"
+	"bytes"
+	"complete_run/config"
+	"complete_run/errreport"
+	"complete_run/mark"
+	"complete_run/redact"
+	"complete_run/resultorder"
+	"complete_run/resultsfile"
+	"complete_run/runids"
+	"complete_run/setup"
+	"complete_run/stdio"
 	"encoding/json"
 	"fmt"
-	"os"
+	"io"
+	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 )
 
-type TestResult struct {
-	Attachments []interface{} `json:"attachments"`
-	CaseID      int           `json:"case_id"`
-	Comment     *string       `json:"comment"`
-	EndTime     string        `json:"end_time"`
-	Hash        string        `json:"hash"`
-	IsAPIResult bool          `json:"is_api_result"`
-	RunID       int           `json:"run_id"`
-	StackTrace  *string       `json:"stacktrace"`
-	Status      string        `json:"status"`
-	Steps       *interface{}  `json:"steps"`
-	TimeSpentMS int           `json:"time_spent_ms"`
-}
-
-func FilterResults() {
-	inputFile := "results.json"
-	outputFile := "filtered.txt"
-
-	file, err := os.Open(inputFile)
+// Filter selects the runs to complete for one configuration, writing its log
+// lines to log
+type Filter struct {
+	cfg  *config.Config
+	log  io.Writer
+	errs errreport.Logger
+}
+
+// New returns a Filter for cfg. It applies the process-wide settings of cfg
+// with setup.Apply.
+func New(cfg *config.Config, log io.Writer) *Filter {
+	setup.Apply(cfg)
+	return &Filter{cfg: cfg, log: log, errs: errreport.To(log)}
+}
+
+// Filter reads the results files and writes the selected run IDs to the
+// filtered file
+func (f *Filter) Filter() error {
+	cfg := f.cfg
+	outputFile := cfg.FilteredPath
+
+	inputFiles, err := resolveInputFiles(cfg.ResultsGlob, cfg.ResultsFile())
 	if err != nil {
-		fmt.Println("Error opening file:", err)
-		return
+		return fmt.Errorf("resolving results files: %v", err)
+	}
+
+	results := newResultSet(f.errs)
+	for _, inputFile := range inputFiles {
+		if err := readResultsFile(inputFile, results); err != nil {
+			return fmt.Errorf("reading results: %v", err)
+		}
+	}
+	if results.duplicates > 0 {
+		fmt.Fprintf(f.log, "Skipped %d duplicate results across %d files\n", results.duplicates, len(inputFiles))
+	}
+	results.warnMissingRunID()
+
+	selectedRunIDs, decisions := processResults(f.log, results.runResults, cfg.MinResults, cfg.TimeSkewTolerance, cfg.StrictPass)
+	if cfg.FilterEvents != "" {
+		if err := writeDecisions(cfg.FilterEvents, decisions); err != nil {
+			return fmt.Errorf("writing filter events: %v", err)
+		}
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	runResults := make(map[int][]TestResult)
+	// Write the selected run_ids to a file
+	if err := writeOutput(selectedRunIDs, outputFile, cfg.RunsFileFormat, cfg.ProjectCode); err != nil {
+		return err
+	}
+
+	if cfg.DiffFiltered != "" {
+		f.diffFiltered(cfg.DiffFiltered, selectedRunIDs, cfg.RunsFileFormat)
+	}
+	return nil
+}
+
+// FilterStream filters result lines as they arrive on lines instead of reading
+// results.json. Lines are only grouped while the stream is open; no run is
+// decided on until the stream is closed, i.e. until every result of every run
+// has been received. fetched then delivers the outcome of the fetch feeding
+// lines: if it failed, nothing is written, so filtered.txt is never built from
+// a partial fetch.
+func (f *Filter) FilterStream(lines <-chan []byte, fetched <-chan error) error {
+	cfg := f.cfg
+	outputFile := cfg.FilteredPath
+	results := newResultSet(f.errs)
+
+	for line := range lines {
+		results.add(line)
+	}
+	if err := <-fetched; err != nil {
+		return fmt.Errorf("not writing %s, fetch did not finish: %w", outputFile, err)
+	}
+	results.warnMissingRunID()
+
+	selectedRunIDs, decisions := processResults(f.log, results.runResults, cfg.MinResults, cfg.TimeSkewTolerance, cfg.StrictPass)
+	if cfg.FilterEvents != "" {
+		if err := writeDecisions(cfg.FilterEvents, decisions); err != nil {
+			return fmt.Errorf("writing filter events: %v", err)
+		}
+	}
+	if err := writeOutput(selectedRunIDs, outputFile, cfg.RunsFileFormat, cfg.ProjectCode); err != nil {
+		return err
+	}
 
-	// Read and parse each line
-	for scanner.Scan() {
-		var result TestResult
-		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
-			fmt.Println("Error parsing JSON:", err)
+	if cfg.DiffFiltered != "" {
+		f.diffFiltered(cfg.DiffFiltered, selectedRunIDs, cfg.RunsFileFormat)
+	}
+	return nil
+}
+
+// FilterInMemory filters result lines already held in memory and returns the
+// selected run IDs instead of writing filtered.txt, for --in-memory
+func (f *Filter) FilterInMemory(lines [][]byte) ([]int, error) {
+	cfg := f.cfg
+	results := newResultSet(f.errs)
+	for _, line := range lines {
+		results.add(line)
+	}
+	if results.duplicates > 0 {
+		fmt.Fprintf(f.log, "Skipped %d duplicate results\n", results.duplicates)
+	}
+	results.warnMissingRunID()
+
+	selectedRunIDs, decisions := processResults(f.log, results.runResults, cfg.MinResults, cfg.TimeSkewTolerance, cfg.StrictPass)
+	if cfg.FilterEvents != "" {
+		if err := writeDecisions(cfg.FilterEvents, decisions); err != nil {
+			return nil, fmt.Errorf("writing filter events: %v", err)
+		}
+	}
+	fmt.Fprintf(f.log, "Selected %d runs for matching\n", len(selectedRunIDs))
+
+	if cfg.DiffFiltered != "" {
+		f.diffFiltered(cfg.DiffFiltered, selectedRunIDs, cfg.RunsFileFormat)
+	}
+	return selectedRunIDs, nil
+}
+
+// resolveInputFiles expands a comma-separated list of globs into the sorted,
+// de-duplicated list of results files to read. An empty pattern means
+// defaultFile, the file fetch wrote.
+func resolveInputFiles(patterns, defaultFile string) ([]string, error) {
+	if strings.TrimSpace(patterns) == "" {
+		return []string{defaultFile}, nil
+	}
+
+	seen := make(map[string]bool)
+	var files []string
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if pattern == stdio.Name {
+			// Read results from stdin
+			if !seen[pattern] {
+				seen[pattern] = true
+				files = append(files, pattern)
+			}
 			continue
 		}
-		runResults[result.RunID] = append(runResults[result.RunID], result)
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %q", pattern)
+		}
+		for _, match := range matches {
+			if !seen[match] {
+				seen[match] = true
+				files = append(files, match)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// readResultsFile reads one results file into results. Gzip files are
+// decompressed; NDJSON and JSON array files are both accepted.
+func readResultsFile(inputFile string, results *resultSet) error {
+	return resultsfile.Each(inputFile, results.add)
+}
+
+// resultSet groups parsed results by run ID. A result whose hash was already
+// seen is dropped, so overlapping input files don't double-count.
+type resultSet struct {
+	runResults   map[int][]resultsfile.Result
+	seenHashes   map[string]bool
+	duplicates   int
+	missingRunID int // Rows without a run_id, which would form a phantom run 0
+	errs         errreport.Logger
+}
+
+func newResultSet(errs errreport.Logger) *resultSet {
+	return &resultSet{
+		runResults: make(map[int][]resultsfile.Result),
+		seenHashes: make(map[string]bool),
+		errs:       errs,
 	}
+}
 
-	if err := scanner.Err(); err != nil {
-		fmt.Println("Error reading file:", err)
+// add parses one result line and groups it under its run ID
+func (s *resultSet) add(line []byte) {
+	var result resultsfile.Result
+	if err := json.Unmarshal(line, &result); err != nil {
+		s.errs.Errorf("filter", "", "Error parsing JSON: %v", err)
 		return
 	}
+	if result.RunID == 0 {
+		s.missingRunID++
+		return
+	}
+	if result.Hash != "" {
+		if s.seenHashes[result.Hash] {
+			s.duplicates++
+			return
+		}
+		s.seenHashes[result.Hash] = true
+	}
+	s.runResults[result.RunID] = append(s.runResults[result.RunID], result)
+}
 
-	selectedRunIDs := processResults(runResults)
+func (s *resultSet) warnMissingRunID() {
+	if s.missingRunID > 0 {
+		s.errs.Warnf("filter", "", "%s Skipped %d results without a run_id", mark.Warn, s.missingRunID)
+	}
+}
 
-	// Write the selected run_ids to a file
-	writeOutput(selectedRunIDs, outputFile)
+// orderEntry describes a result at position pos of its case's results, which
+// are kept in input order
+func orderEntry(result resultsfile.Result, pos int) resultorder.Entry {
+	return resultorder.Entry{EndTime: result.EndTime, Status: result.Status, Pos: pos}
+}
+
+// runDecision explains why filter kept or dropped a run, for --filter-events
+type runDecision struct {
+	RunID       int    `json:"run_id"`
+	Kept        bool   `json:"kept"`
+	TotalCases  int    `json:"total_cases"`
+	CasesPassed int    `json:"cases_passed"` // Cases whose latest result passed, or every result with --strict-pass
+	CasesFailed int    `json:"cases_failed"`
+	Reason      string `json:"decision_reason"`
 }
 
-func processResults(runResults map[int][]TestResult) []int {
+// processResults selects the run IDs whose results qualify for completion and
+// returns the decision for every run, both sorted by run ID, logging skipped
+// runs to log. Runs are decided by decideLatestPassed, or by decideStrictPass
+// when strict is set. Runs with fewer than minResults results are never
+// selected: with no results at all the "every result passed" check would hold
+// vacuously.
+func processResults(log io.Writer, runResults map[int][]resultsfile.Result, minResults int, skewTolerance time.Duration, strict bool) ([]int, []runDecision) {
 	var selectedRunIDs []int
+	var decisions []runDecision
 
 	for runID, results := range runResults {
-		allPassed := true
-		caseStatuses := make(map[int][]TestResult)
+		if len(results) == 0 || len(results) < minResults {
+			fmt.Fprintf(log, "Skipping run %s: only %d results (minimum %d)\n", redact.ID(runID), len(results), max(minResults, 1))
+			decisions = append(decisions, runDecision{
+				RunID:  runID,
+				Reason: fmt.Sprintf("only %d results (minimum %d)", len(results), max(minResults, 1)),
+			})
+			continue
+		}
 
-		for _, result := range results {
-			if result.Status != "passed" {
-				allPassed = false
-			}
-			caseStatuses[result.CaseID] = append(caseStatuses[result.CaseID], result)
+		var decision runDecision
+		if strict {
+			decision = decideStrictPass(runID, results)
+		} else {
+			decision = decideLatestPassed(runID, results, skewTolerance)
 		}
+		decisions = append(decisions, decision)
 
-		if allPassed {
+		if decision.Kept {
 			selectedRunIDs = append(selectedRunIDs, runID)
-			continue
 		}
+	}
+
+	resultorder.WarnUnparseable(log, "filter")
+	sort.Ints(selectedRunIDs)
+	sort.Slice(decisions, func(i, j int) bool { return decisions[i].RunID < decisions[j].RunID })
+	return selectedRunIDs, decisions
+}
+
+// groupByCase groups a run's results by case ID, keeping input order
+func groupByCase(results []resultsfile.Result) map[int][]resultsfile.Result {
+	caseResults := make(map[int][]resultsfile.Result)
+	for _, result := range results {
+		caseResults[result.CaseID] = append(caseResults[result.CaseID], result)
+	}
+	return caseResults
+}
 
-		keepRunID := false
-		for _, caseResults := range caseStatuses {
-			hasPassed := false
-			latestPassedTime := ""
-			latestOverallTime := ""
-			latestOverallStatus := ""
-
-			for _, result := range caseResults {
-				// Track the latest overall result (regardless of status)
-				if result.EndTime > latestOverallTime {
-					latestOverallTime = result.EndTime
-					latestOverallStatus = result.Status
-				}
-
-				// Track the latest passed result
-				if result.Status == "passed" {
-					hasPassed = true
-					if result.EndTime > latestPassedTime {
-						latestPassedTime = result.EndTime
-					}
-				}
+// decideLatestPassed keeps the run only if the latest result of every case is
+// a "passed" result, ordered as described in resultorder.Later, so a case that
+// failed and then passed on a re-run counts as passed. This is the default.
+func decideLatestPassed(runID int, results []resultsfile.Result, skewTolerance time.Duration) runDecision {
+	allPassed := true
+	for _, result := range results {
+		if result.Status != "passed" {
+			allPassed = false
+		}
+	}
+
+	caseStatuses := groupByCase(results)
+	decision := runDecision{RunID: runID, TotalCases: len(caseStatuses)}
+	for _, caseResults := range caseStatuses {
+		latest := 0
+		for i := 1; i < len(caseResults); i++ {
+			if resultorder.Later(orderEntry(caseResults[latest], latest), orderEntry(caseResults[i], i), skewTolerance) {
+				latest = i
 			}
+		}
+
+		if caseResults[latest].Status == "passed" {
+			decision.CasesPassed++
+		} else {
+			decision.CasesFailed++
+		}
+	}
 
-			if hasPassed {
-				// Only keep the run if the latest result overall is a "passed" result
-				if latestPassedTime == latestOverallTime && latestOverallStatus == "passed" {
-					keepRunID = true
-				} else {
-					keepRunID = false
-					break // No need to check further, discard the run
-				}
-			} else {
-				// If there's no pass at all for this case, discard the run
-				keepRunID = false
+	decision.Kept = decision.CasesFailed == 0
+	switch {
+	case allPassed:
+		decision.Reason = "every result passed"
+	case decision.Kept:
+		decision.Reason = "every case passed on its latest result"
+	default:
+		decision.Reason = fmt.Sprintf("%d cases did not pass on their latest result", decision.CasesFailed)
+	}
+	return decision
+}
+
+// decideStrictPass keeps the run only if every single result passed, so a case
+// that ever failed drops the run even if a re-run passed. Set via --strict-pass.
+func decideStrictPass(runID int, results []resultsfile.Result) runDecision {
+	caseStatuses := groupByCase(results)
+	decision := runDecision{RunID: runID, TotalCases: len(caseStatuses)}
+	for _, caseResults := range caseStatuses {
+		passed := true
+		for _, result := range caseResults {
+			if result.Status != "passed" {
+				passed = false
 				break
 			}
 		}
+		if passed {
+			decision.CasesPassed++
+		} else {
+			decision.CasesFailed++
+		}
+	}
 
-		if keepRunID {
-			selectedRunIDs = append(selectedRunIDs, runID)
+	decision.Kept = decision.CasesFailed == 0
+	if decision.Kept {
+		decision.Reason = "every result passed"
+	} else {
+		decision.Reason = fmt.Sprintf("%d cases have a non-passed result (--strict-pass)", decision.CasesFailed)
+	}
+	return decision
+}
+
+// writeDecisions writes one JSON object per run to path, or stdout for "-"
+func writeDecisions(path string, decisions []runDecision) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, decision := range decisions {
+		if err := encoder.Encode(decision); err != nil {
+			return err
 		}
 	}
+	return stdio.WriteFile(path, buf.Bytes())
+}
 
-	sort.Ints(selectedRunIDs)
-	return selectedRunIDs
+// writeOutput writes the selected run IDs to outputFile, or stdout for "-". An
+// empty selection produces an empty file (or [] in JSON format) rather than
+// stray separators.
+func writeOutput(runIDs []int, outputFile, format, projectCode string) error {
+	if err := runids.Write(outputFile, runIDs, format); err != nil {
+		return fmt.Errorf("writing %s: %v", outputFile, err)
+	}
+
+	if projectCode != "" {
+		if err := runids.WriteMeta(outputFile, projectCode); err != nil {
+			return fmt.Errorf("writing project stamp: %v", err)
+		}
+	}
+	return nil
 }
 
-func writeOutput(runIDs []int, outputFile string) {
-	file, err := os.Create(outputFile)
+// diffFiltered prints the run IDs added and removed compared to a previous
+// filtered.txt, to explain why the selection changed between runs
+func (f *Filter) diffFiltered(previousFile string, runIDs []int, format string) {
+	previous, err := runids.Read(previousFile, format, f.log)
 	if err != nil {
-		fmt.Println("Error creating output file:", err)
+		f.errs.Errorf("filter", "", "Error reading previous filtered file: %v", err)
 		return
 	}
-	defer file.Close()
 
-	output := strings.Trim(strings.Join(strings.Fields(fmt.Sprint(runIDs)), ","), "[]")
-	_, err = file.WriteString(output)
-	if err != nil {
-		fmt.Println("Error writing to file:", err)
-	}
+	added, removed := runids.Diff(previous, runIDs)
+	fmt.Fprintf(f.log, "Compared with %s: %d added, %d removed\n", previousFile, len(added), len(removed))
+	fmt.Fprintf(f.log, "  Added:   %s\n", redact.IDs(added))
+	fmt.Fprintf(f.log, "  Removed: %s\n", redact.IDs(removed))
 }
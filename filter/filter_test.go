@@ -0,0 +1,251 @@
+package filter
+
+import (
+	"bytes"
+	"complete_run/config"
+	"complete_run/errreport"
+	"complete_run/resultsfile"
+	"complete_run/runids"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// result returns a result of case caseID in run 1 that ended at second
+// seconds past noon
+func result(caseID int, status string, second int) resultsfile.Result {
+	end := time.Date(2024, 3, 1, 12, 0, second, 0, time.UTC)
+	return resultsfile.Result{RunID: 1, CaseID: caseID, Status: status, EndTime: end.Format(time.RFC3339)}
+}
+
+func TestDecide(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []resultsfile.Result
+		latest  bool // Kept by decideLatestPassed
+		strict  bool // Kept by decideStrictPass
+	}{
+		{"all passed", []resultsfile.Result{result(1, "passed", 0), result(2, "passed", 1)}, true, true},
+		{"failed then passed", []resultsfile.Result{result(1, "failed", 0), result(1, "passed", 1), result(2, "passed", 0)}, true, false},
+		{"retried then passed", []resultsfile.Result{result(1, "failed", 0), result(1, "blocked", 1), result(1, "failed", 2), result(1, "passed", 3)}, true, false},
+		// The file order does not matter, only the end times
+		{"passed after a later-listed failure", []resultsfile.Result{result(1, "passed", 5), result(1, "failed", 1)}, true, false},
+		{"passed then failed", []resultsfile.Result{result(1, "passed", 0), result(1, "failed", 1), result(2, "passed", 0)}, false, false},
+		{"one case never passed", []resultsfile.Result{result(1, "passed", 0), result(2, "skipped", 0)}, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			latest := decideLatestPassed(1, test.results, 0)
+			if latest.Kept != test.latest {
+				t.Errorf("decideLatestPassed kept %v (%s), want %v", latest.Kept, latest.Reason, test.latest)
+			}
+			strict := decideStrictPass(1, test.results)
+			if strict.Kept != test.strict {
+				t.Errorf("decideStrictPass kept %v (%s), want %v", strict.Kept, strict.Reason, test.strict)
+			}
+			if latest.TotalCases != strict.TotalCases || latest.CasesPassed+latest.CasesFailed != latest.TotalCases {
+				t.Errorf("case counts: latest %+v, strict %+v", latest, strict)
+			}
+		})
+	}
+}
+
+func TestDecideReasons(t *testing.T) {
+	allPassed := []resultsfile.Result{result(1, "passed", 0)}
+	rerun := []resultsfile.Result{result(1, "failed", 0), result(1, "passed", 1)}
+
+	tests := []struct {
+		decision runDecision
+		want     string
+	}{
+		{decideLatestPassed(1, allPassed, 0), "every result passed"},
+		{decideLatestPassed(1, rerun, 0), "every case passed on its latest result"},
+		{decideStrictPass(1, allPassed), "every result passed"},
+		{decideStrictPass(1, rerun), "1 cases have a non-passed result (--strict-pass)"},
+	}
+	for _, test := range tests {
+		if test.decision.Reason != test.want {
+			t.Errorf("reason %q, want %q", test.decision.Reason, test.want)
+		}
+	}
+}
+
+func TestWriteOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		runIDs []int
+		format string
+		want   string
+	}{
+		{"empty", nil, runids.FormatAuto, ""},
+		{"empty JSON", nil, runids.FormatJSON, "[]"},
+		{"single", []int{42}, runids.FormatAuto, "42"},
+		{"single JSON", []int{42}, runids.FormatJSON, "[42]"},
+		{"many", []int{3, 17, 42, 1000000}, runids.FormatCSV, "3,17,42,1000000"},
+		{"many JSON", []int{3, 17, 42, 1000000}, runids.FormatJSON, "[3,17,42,1000000]"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "filtered.txt")
+			if err := writeOutput(test.runIDs, path, test.format, "DEMO"); err != nil {
+				t.Fatalf("writeOutput failed: %v", err)
+			}
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != test.want {
+				t.Errorf("wrote %q, want %q", content, test.want)
+			}
+
+			// What match and complete read back is what was written
+			read, err := runids.Read(path, runids.FormatAuto, io.Discard)
+			if err != nil {
+				t.Fatalf("reading the output back failed: %v", err)
+			}
+			if !slices.Equal(read, test.runIDs) {
+				t.Errorf("read back %v, want %v", read, test.runIDs)
+			}
+			if meta, err := runids.ReadMeta(path); err != nil || meta.ProjectCode != "DEMO" {
+				t.Errorf("project stamp %+v, %v; want DEMO", meta, err)
+			}
+		})
+	}
+}
+
+func TestProcessResultsSkipsRunsWithoutEnoughResults(t *testing.T) {
+	runResults := map[int][]resultsfile.Result{
+		1: {},
+		2: {result(1, "passed", 0)},
+		3: {result(1, "passed", 0), result(2, "passed", 0)},
+	}
+	tests := []struct {
+		minResults int
+		selected   []int
+	}{
+		{0, []int{2, 3}}, // A run without results never passes vacuously
+		{1, []int{2, 3}},
+		{2, []int{3}},
+		{3, nil},
+	}
+	for _, test := range tests {
+		selected, decisions := processResults(io.Discard, runResults, test.minResults, 0, false)
+		if !slices.Equal(selected, test.selected) {
+			t.Errorf("minimum %d: selected %v, want %v", test.minResults, selected, test.selected)
+		}
+		if len(decisions) != 3 || decisions[0].RunID != 1 || decisions[0].Kept || decisions[0].Reason != fmt.Sprintf("only 0 results (minimum %d)", max(test.minResults, 1)) {
+			t.Errorf("minimum %d: decisions %+v, want run 1 dropped for having no results", test.minResults, decisions)
+		}
+	}
+}
+
+func TestDecideLatestPassedIdenticalTimestamps(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []resultsfile.Result
+		kept    bool
+	}{
+		// A failure at the same second as a pass wins, whichever is listed last
+		{"pass listed last", []resultsfile.Result{result(1, "failed", 0), result(1, "passed", 0)}, false},
+		{"failure listed last", []resultsfile.Result{result(1, "passed", 0), result(1, "failed", 0)}, false},
+		{"two passes", []resultsfile.Result{result(1, "passed", 0), result(1, "passed", 0)}, true},
+		{"later pass", []resultsfile.Result{result(1, "failed", 0), result(1, "passed", 0), result(1, "passed", 1)}, true},
+	}
+	for _, test := range tests {
+		if decision := decideLatestPassed(1, test.results, 0); decision.Kept != test.kept {
+			t.Errorf("%s: kept %v (%s), want %v", test.name, decision.Kept, decision.Reason, test.kept)
+		}
+	}
+}
+
+func TestResultSetSkipsRowsWithoutRunID(t *testing.T) {
+	var log bytes.Buffer
+	results := newResultSet(errreport.To(&log))
+	for _, line := range []string{
+		`{"run_id":1,"case_id":1,"status":"passed","hash":"a"}`,
+		`{"case_id":2,"status":"failed","hash":"b"}`,
+		`{"run_id":0,"case_id":3,"status":"failed","hash":"c"}`,
+		`{"run_id":null,"case_id":4,"status":"failed","hash":"d"}`,
+	} {
+		results.add([]byte(line))
+	}
+	results.warnMissingRunID()
+
+	if _, ok := results.runResults[0]; ok || len(results.runResults) != 1 {
+		t.Errorf("grouped runs %v, want only run 1 and no run 0", results.runResults)
+	}
+	if results.missingRunID != 3 || !strings.Contains(log.String(), "Skipped 3 results without a run_id") {
+		t.Errorf("counted %d rows without a run_id, logged %q; want 3", results.missingRunID, log.String())
+	}
+}
+
+// streamFilter streams lines into FilterStream, ending the fetch with fetchErr,
+// and returns the filter's error. A previous invocation left filtered.txt in dir
+// listing runs 1 and 2 for project OLD.
+func streamFilter(t *testing.T, dir string, lines []string, fetchErr error) error {
+	t.Helper()
+	cfg, err := config.Defaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ProjectCode = "DEMO"
+	cfg.FilteredPath = filepath.Join(dir, "filtered.txt")
+	if err := writeOutput([]int{1, 2}, cfg.FilteredPath, runids.FormatAuto, "OLD"); err != nil {
+		t.Fatal(err)
+	}
+
+	stream := make(chan []byte)
+	fetched := make(chan error, 1)
+	filtered := make(chan error, 1)
+	go func() { filtered <- New(cfg, io.Discard).FilterStream(stream, fetched) }()
+	for _, line := range lines {
+		stream <- []byte(line)
+	}
+	close(stream)
+	fetched <- fetchErr
+	return <-filtered
+}
+
+func TestFilterStream(t *testing.T) {
+	// Each run passed as far as the streamed results show
+	lines := []string{
+		`{"run_id":5,"case_id":1,"status":"passed","end_time":"2024-03-01T12:00:00Z"}`,
+		`{"run_id":6,"case_id":1,"status":"passed","end_time":"2024-03-01T12:00:00Z"}`,
+	}
+
+	t.Run("fetch fails mid-stream", func(t *testing.T) {
+		dir := t.TempDir()
+		fetchErr := errors.New("3 pages and 0 partitions failed; results are incomplete")
+		if err := streamFilter(t, dir, lines, fetchErr); !errors.Is(err, fetchErr) {
+			t.Errorf("err = %v, want the fetch error", err)
+		}
+		// The previous invocation's files are left alone
+		read, err := runids.Read(filepath.Join(dir, "filtered.txt"), runids.FormatAuto, io.Discard)
+		if err != nil || !slices.Equal(read, []int{1, 2}) {
+			t.Errorf("filtered.txt lists %v (%v), want the previous 1,2", read, err)
+		}
+		if meta, err := runids.ReadMeta(filepath.Join(dir, "filtered.txt")); err != nil || meta.ProjectCode != "OLD" {
+			t.Errorf("project stamp %+v, %v; want the previous OLD", meta, err)
+		}
+	})
+
+	t.Run("fetch succeeds", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := streamFilter(t, dir, lines, nil); err != nil {
+			t.Fatalf("FilterStream failed: %v", err)
+		}
+		read, err := runids.Read(filepath.Join(dir, "filtered.txt"), runids.FormatAuto, io.Discard)
+		if err != nil || !slices.Equal(read, []int{5, 6}) {
+			t.Errorf("filtered.txt lists %v (%v), want 5,6", read, err)
+		}
+		if meta, err := runids.ReadMeta(filepath.Join(dir, "filtered.txt")); err != nil || meta.ProjectCode != "DEMO" {
+			t.Errorf("project stamp %+v, %v; want DEMO", meta, err)
+		}
+	})
+}
@@ -2,30 +2,287 @@ package main
 
 import (
 	"complete_run/complete"
+	"complete_run/config"
+	"complete_run/errreport"
+	"complete_run/events"
 	"complete_run/fetch"
 	"complete_run/filter"
+	"complete_run/mark"
 	"complete_run/match"
-	"flag"
+	"complete_run/preflight"
+	"complete_run/qase"
+	"complete_run/quota"
+	"complete_run/setup"
+	"complete_run/stdio"
+	"complete_run/transport"
+	"complete_run/webhook"
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Exit statuses: a stage failed outright, or complete went through its runs but
+// some of them failed to complete
+const (
+	exitFailed     = 1
+	exitRunsFailed = 2
 )
 
 func main() {
-	completeAll := flag.Bool("complete-all", false, "Mark all in-progress test runs as complete")
-	flag.Parse()
+	if err := run(); err != nil {
+		fmt.Println("Error:", err)
+		if errors.Is(err, complete.ErrRunsFailed) {
+			os.Exit(exitRunsFailed)
+		}
+		os.Exit(exitFailed)
+	}
+}
+
+// run executes the configured mode and returns the first stage failure. It is
+// separate from main so deferred reports are written before the process exits.
+func run() (err error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("loading configuration: %v", err)
+	}
+
+	if cfg.HelpConfig {
+		config.PrintHelp(os.Stdout)
+		return nil
+	}
+
+	// Data written to stdout must not be interleaved with log lines
+	if cfg.WritesToStdout() {
+		stdio.LogsToStderr()
+	}
+	if cfg.Events {
+		events.Enable(stdio.Out)
+	}
+	// Emoji markers are noise in CI logs and files
+	if cfg.NoColor || !mark.IsTerminal(os.Stdout) {
+		mark.Plain()
+	}
+
+	setup.Apply(cfg)
+	defer transport.ReportThrottling(os.Stdout, cfg.ThrottleWarnRatio)
+	defer errreport.Report(os.Stdout, cfg.ErrorReport)
+	if cfg.CompletedWebhookPerRun != "" {
+		webhook.EnableRunCallbacks(cfg.CompletedWebhookPerRun, cfg.WebhookConcurrency, cfg.WebhookTimeout)
+	}
+
+	// Catch missing files and directories before any API calls are spent
+	if problems := preflight.Check(cfg); len(problems) > 0 {
+		fmt.Println("Preflight check failed:")
+		for _, problem := range problems {
+			fmt.Println("  -", problem)
+		}
+		return errors.New("preflight check failed")
+	}
+	if cfg.ValidateConfig {
+		fmt.Println("Preflight check passed")
+		return nil
+	}
+
+	// One client for every stage, so they share keep-alive connections
+	api := qase.Default(cfg.APIToken)
+
+	if cfg.EstimateQuota {
+		if err := quota.PrintEstimate(os.Stdout, cfg, api); err != nil {
+			return fmt.Errorf("estimating API quota: %w", err)
+		}
+		return nil
+	}
+
+	// Ctrl-C stops new requests and retries; what already ran is still reported
+	ctx := interruptContext()
+	fetcher := fetch.New(cfg, api, os.Stdout)
+	filterer := filter.New(cfg, os.Stdout)
+	matcher := match.New(cfg, api, os.Stdout)
+	completer := complete.New(cfg, api, os.Stdout)
+
+	// A dry run sends no webhooks
+	if cfg.SummaryWebhook != "" && !cfg.DryRun {
+		defer func() { notifySummary(cfg, fetcher, completer, err) }()
+	}
+
+	if cfg.ListInProgress {
+		fmt.Println("Listing In-Progress Runs...")
+		return stageFailed(ctx, "complete", completer.ListInProgressRuns(ctx))
+	}
+
+	if len(cfg.ByTitle) > 0 || len(cfg.ByKey) > 0 {
+		fmt.Println("Completing runs by title or key...")
+		return stageFailed(ctx, "complete", completer.CompleteRunRefs(ctx))
+	}
+
+	if len(cfg.RunIDs) > 0 {
+		fmt.Printf("Completing %d runs given by --run-ids...\n", len(cfg.RunIDs))
+		return stageFailed(ctx, "complete", completer.CompleteRunsInMemory(ctx, cfg.RunIDs))
+	}
+
+	if cfg.RetryFailed != "" {
+		fmt.Println("Retrying failed runs...")
+		return stageFailed(ctx, "complete", completer.CompleteFailedRuns(ctx))
+	}
 
-	if *completeAll {
+	if cfg.CompleteAll {
 		fmt.Println("Starting Complete All In-Progress Runs...")
-		complete.CompleteAllInProgressRuns()
+		if err := stageFailed(ctx, "complete", completer.CompleteAllInProgressRuns(ctx)); err != nil {
+			return err
+		}
 		fmt.Println("Complete All execution finished successfully!")
-		return
+		return nil
+	}
+
+	// A stage command runs one stage on the files an earlier invocation wrote
+	switch cfg.Command {
+	case config.CommandFetch:
+		return stageFailed(ctx, "fetch", fetcher.Fetch(ctx))
+	case config.CommandFilter:
+		return stageFailed(ctx, "filter", filterer.Filter())
+	case config.CommandMatch:
+		return stageFailed(ctx, "match", matcher.Match(ctx))
+	case config.CommandComplete:
+		return stageFailed(ctx, "complete", completer.CompleteRuns(ctx))
 	}
 
 	fmt.Println("Starting Qase Automation Pipeline...")
 
-	fetch.FetchResults()
-	filter.FilterResults()
-	match.MatchResults()
-	complete.CompleteRuns()
+	if cfg.InMemory {
+		// Stages hand data to each other directly; no intermediate files are written
+		lines, err := fetcher.FetchInMemory(ctx)
+		if err := stageFailed(ctx, "fetch", err); err != nil {
+			return err
+		}
+		runIDs, err := filterer.FilterInMemory(lines)
+		if err := stageFailed(ctx, "filter", err); err != nil {
+			return err
+		}
+		runIDs, err = matcher.MatchInMemory(ctx, runIDs, lines)
+		if err := stageFailed(ctx, "match", err); err != nil {
+			return err
+		}
+		if cfg.ValidateOnly {
+			fmt.Println("Validation preview finished; --validate-only skips completing runs")
+			return nil
+		}
+		if err := stageFailed(ctx, "complete", completer.CompleteRunsInMemory(ctx, runIDs)); err != nil {
+			return err
+		}
+		fmt.Println("Pipeline execution finished successfully!")
+		return nil
+	}
+
+	if cfg.ConcurrentStages {
+		// Filter groups results while fetch streams them and decides once fetch
+		// is done, writing nothing unless it succeeded
+		lines := make(chan []byte, 1000)
+		fetched := make(chan error, 1)
+		filtered := make(chan error, 1)
+		go func() {
+			filtered <- filterer.FilterStream(lines, fetched)
+		}()
+		fetchErr := fetcher.FetchStreaming(ctx, lines)
+		fetched <- fetchErr
+		filterErr := <-filtered
+		if err := stageFailed(ctx, "fetch", fetchErr); err != nil {
+			return err
+		}
+		if err := stageFailed(ctx, "filter", filterErr); err != nil {
+			return err
+		}
+	} else {
+		if err := stageFailed(ctx, "fetch", fetcher.Fetch(ctx)); err != nil {
+			return err
+		}
+		if err := stageFailed(ctx, "filter", filterer.Filter()); err != nil {
+			return err
+		}
+	}
+	if err := stageFailed(ctx, "match", matcher.Match(ctx)); err != nil {
+		return err
+	}
+	if cfg.ValidateOnly {
+		fmt.Println("Validation preview finished; --validate-only skips completing runs")
+		return nil
+	}
+	if err := stageFailed(ctx, "complete", completer.CompleteRuns(ctx)); err != nil {
+		return err
+	}
 
 	fmt.Println("Pipeline execution finished successfully!")
+	return nil
+}
+
+// summary is the payload of --summary-webhook. Fetch and Complete are the
+// --fetch-report and --complete-report of the stages that ran.
+type summary struct {
+	ProjectCode     string           `json:"project_code"`
+	Success         bool             `json:"success"`
+	Error           string           `json:"error,omitempty"`
+	Failed          int              `json:"failed"`
+	FetchIncomplete bool             `json:"fetch_incomplete"`
+	Fetch           *fetch.Report    `json:"fetch,omitempty"`
+	Complete        *complete.Report `json:"complete,omitempty"`
+	Timestamp       string           `json:"timestamp"`
+}
+
+// notifySummary POSTs the summary of an invocation that ended with err to
+// --summary-webhook. With --notify-on-failure-only it is only sent when runs
+// failed to complete or fetch was incomplete. A failed POST is only logged.
+func notifySummary(cfg *config.Config, fetcher *fetch.Fetcher, completer *complete.Completer, err error) {
+	s := summary{
+		ProjectCode: cfg.ProjectCode,
+		Success:     err == nil,
+		Fetch:       fetcher.Report(),
+		Complete:    completer.Report(),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	if s.Complete != nil {
+		s.Failed = s.Complete.Failed
+	}
+	s.FetchIncomplete = s.Fetch != nil && !s.Fetch.Complete
+	if cfg.NotifyOnFailureOnly && s.Failed == 0 && !s.FetchIncomplete {
+		return
+	}
+	if err := webhook.SendSummary(cfg.SummaryWebhook, cfg.WebhookTimeout, s); err != nil {
+		fmt.Println("Summary webhook failed:", err)
+	}
+}
+
+// stageFailed records a stage failure in the error report and names the stage
+// in the returned error. A stage that returned nil but was cut short by an
+// interrupt also fails, so no later stage starts; otherwise nil is returned.
+func stageFailed(ctx context.Context, stage string, err error) error {
+	if err == nil && ctx.Err() != nil {
+		err = errors.New("interrupted")
+	}
+	if err == nil {
+		return nil
+	}
+	errreport.Record(errreport.Error, stage, "", err.Error())
+	return fmt.Errorf("%s stage failed: %w", stage, err)
+}
+
+// interruptContext returns a context that is canceled on the first SIGINT or
+// SIGTERM. The default handling is restored then, so a second Ctrl-C quits
+// immediately instead of waiting for in-flight requests.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		fmt.Printf("Received %v; finishing in-flight requests (press Ctrl-C again to quit immediately)\n", sig)
+		cancel()
+	}()
+	return ctx
 }
@@ -0,0 +1,27 @@
+package mark
+
+import "os"
+
+// Status markers used in log lines. Emoji by default; Plain swaps them for
+// ASCII words that survive CI log files.
+var (
+	OK   = "✅"
+	Fail = "❌"
+	Warn = "⚠️"
+	Time = "⏱️"
+)
+
+// Plain switches the markers to ASCII. Call it before any output is written.
+func Plain() {
+	OK = "OK"
+	Fail = "FAIL"
+	Warn = "WARN"
+	Time = "TIME"
+}
+
+// IsTerminal reports whether f is an interactive terminal rather than a file
+// or pipe
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,76 @@
+package match
+
+import (
+	"complete_run/redact"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// runInfo is what match needs to know about a run, fetched from the API or
+// read from the --cache-dir entry of an earlier lookup
+type runInfo struct {
+	Status    int       `json:"status"`
+	Cases     []int     `json:"cases"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// cachePath is the entry of a run. The project code is part of the name since
+// run IDs are only unique within a project.
+func (m *Matcher) cachePath(runID int) string {
+	return filepath.Join(m.cacheDir, fmt.Sprintf("%s-%d.json", m.cfg.ProjectCode, runID))
+}
+
+// readCachedRun returns the cached lookup of a run, or nil when there is no
+// entry, it cannot be read or it is older than the cache TTL
+func (m *Matcher) readCachedRun(runID int) *runInfo {
+	if m.cacheDir == "" {
+		return nil
+	}
+	data, err := os.ReadFile(m.cachePath(runID))
+	if err != nil {
+		return nil
+	}
+	var info runInfo
+	if json.Unmarshal(data, &info) != nil || clk.Now().Sub(info.FetchedAt) > m.cacheTTL {
+		return nil
+	}
+	return &info
+}
+
+// writeCachedRun stores the lookup of a run. The entry is written to a
+// temporary file and renamed into place, so concurrent workers and
+// invocations never read a half-written entry. A failed write only costs a
+// request next time and is reported as a warning.
+func (m *Matcher) writeCachedRun(runID int, info *runInfo) {
+	if m.cacheDir == "" {
+		return
+	}
+	data, err := json.Marshal(info)
+	if err == nil {
+		err = writeAtomically(m.cachePath(runID), data)
+	}
+	if err != nil {
+		m.errs.Warnf("match", "run="+redact.ID(runID), "Error caching run %s: %v", redact.ID(runID), err)
+	}
+}
+
+func writeAtomically(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".run-*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
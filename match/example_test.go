@@ -0,0 +1,42 @@
+package match_test
+
+import (
+	"complete_run/config"
+	"complete_run/match"
+	"complete_run/qase"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+)
+
+// A Matcher looks runs up through the client it is given, so it can be pointed
+// at an httptest.Server standing in for the Qase API
+func ExampleMatcher_MatchInMemory() {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Run 1 is in progress; run 2 is already complete
+		status := 0
+		if r.URL.Path == "/run/DEMO/2" {
+			status = 1
+		}
+		fmt.Fprintf(w, `{"status":true,"result":{"status":%d,"cases":[1]}}`, status)
+	}))
+	defer srv.Close()
+
+	cfg, _ := config.Defaults()
+	cfg.APIToken, cfg.ProjectCode = "token", "DEMO"
+	m := match.New(cfg, qase.New(srv.URL, "token", srv.Client()), io.Discard)
+
+	results := [][]byte{
+		[]byte(`{"run_id":1,"case_id":1,"status":"passed","end_time":"2024-03-01T12:00:00Z"}`),
+		[]byte(`{"run_id":2,"case_id":1,"status":"passed","end_time":"2024-03-01T12:00:00Z"}`),
+	}
+	valid, err := m.MatchInMemory(context.Background(), []int{1, 2}, results)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(valid)
+	// Output: [1]
+}
@@ -1,178 +1,411 @@
 package match
 
 import (
-	"bufio"
+	"complete_run/clock"
+	"complete_run/config"
+	"complete_run/errreport"
+	"complete_run/mark"
+	"complete_run/qase"
+	"complete_run/redact"
+	"complete_run/resultorder"
+	"complete_run/resultsfile"
+	"complete_run/retry"
+	"complete_run/runids"
+	"complete_run/setup"
+	"complete_run/stdio"
+	"complete_run/transport"
+	"complete_run/verbose"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 )
 
-type APIResponse struct {
-	Status bool `json:"status"`
-	Result struct {
-		ID     int   `json:"id"`
-		Status int   `json:"status"`
-		Cases  []int `json:"cases"`
-	} `json:"result"`
+// Request rate and number of outstanding run lookups unless --rps/--concurrency
+// are set
+const (
+	DefaultRPS     = 5
+	defaultWorkers = 5
+)
+
+// Clock used for rate limiting; swappable for deterministic timing
+var clk = clock.Real
+
+// Matcher checks the filtered runs against the API and their results for one
+// configuration, writing its log lines to log. A Matcher runs one match at a
+// time.
+type Matcher struct {
+	cfg  *config.Config
+	api  *qase.Client
+	log  io.Writer
+	errs errreport.Logger
+
+	// Directory of the run lookup cache, empty when disabled, and how long an
+	// entry is used before the run is fetched again, from --cache-dir and
+	// --cache-ttl
+	cacheDir string
+	cacheTTL time.Duration
 }
 
-type TestResult struct {
-	RunID   int    `json:"run_id"`
-	CaseID  int    `json:"case_id"`
-	Status  string `json:"status"`
-	EndTime string `json:"end_time"`
+// New returns a Matcher looking runs up through api. It applies the
+// process-wide settings of cfg with setup.Apply.
+func New(cfg *config.Config, api *qase.Client, log io.Writer) *Matcher {
+	setup.Apply(cfg)
+	return &Matcher{
+		cfg:      cfg,
+		api:      api.WithLog(log),
+		log:      log,
+		errs:     errreport.To(log),
+		cacheDir: cfg.CacheDir,
+		cacheTTL: cfg.CacheTTL,
+	}
 }
 
-func MatchResults() {
-	apiToken := os.Getenv("QASE_API_TOKEN")
-	projectCode := os.Getenv("QASE_PROJECT_CODE")
-	if apiToken == "" || projectCode == "" {
-		fmt.Println("Missing API token or project code in environment variables")
-		return
+// Match checks the run IDs of the filtered file and writes the valid ones to
+// the final file, or the preview file with --validate-only
+func (m *Matcher) Match(ctx context.Context) error {
+	cfg := m.cfg
+	if cfg.APIToken == "" || cfg.ProjectCode == "" {
+		return errors.New("missing API token or project code in environment variables")
 	}
 
-	runIDs := readRunIDs("filtered.txt")
-	results := readResults("results.json")
-	validRunIDs := []string{}
+	runIDs, err := m.readRunIDs(cfg.FilteredPath, cfg.RunsFileFormat)
+	if err != nil {
+		return err
+	}
+	results, err := m.readResults(cfg.ResultsFile())
+	if err != nil {
+		return err
+	}
+	validRunIDs, rejected, err := m.matchRunIDs(ctx, runIDs, results)
+	if err != nil {
+		return err
+	}
+	if cfg.ValidateOnly {
+		m.reportValidation(validRunIDs, rejected)
+		return m.writeValidRunIDs(cfg.PreviewFile(), validRunIDs)
+	}
+	return m.writeValidRunIDs(cfg.FinalPath, validRunIDs)
+}
 
-	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, 5) // Limit to 5 requests per second
+// MatchInMemory validates runIDs against result lines held in memory and
+// returns the valid run IDs instead of writing final.txt, for --in-memory
+func (m *Matcher) MatchInMemory(ctx context.Context, runIDs []int, lines [][]byte) ([]int, error) {
+	cfg := m.cfg
+	if cfg.APIToken == "" || cfg.ProjectCode == "" {
+		return nil, errors.New("missing API token or project code in environment variables")
+	}
+
+	results := make(map[int][]resultsfile.Result)
+	total, missingRunID := 0, 0
+	for _, line := range lines {
+		if result, ok := m.parseResult(line); ok {
+			if result.RunID == 0 {
+				missingRunID++
+				continue
+			}
+			results[result.RunID] = append(results[result.RunID], result)
+			total++
+		}
+	}
+	m.warnMissingRunID(missingRunID)
+	fmt.Fprintf(m.log, "Total test results read: %d\n", total)
+
+	validRunIDs, rejected, err := m.matchRunIDs(ctx, runIDs, results)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ValidateOnly {
+		m.reportValidation(validRunIDs, rejected)
+		return nil, nil
+	}
+	fmt.Fprintf(m.log, "%d runIDs are valid\n", len(validRunIDs))
+	verbose.Fprintf(m.log, "Final list of valid runIDs: %s\n", redact.IDs(validRunIDs))
+	return validRunIDs, nil
+}
+
+// matchRunIDs checks every run against the API and results, returning the
+// valid run IDs and the reason each other run was rejected. Rejected runs go to
+// the quarantine file if one is configured. results holds each run's results
+// in input order.
+func (m *Matcher) matchRunIDs(ctx context.Context, runIDs []int, results map[int][]resultsfile.Result) ([]int, map[int]string, error) {
+	cfg := m.cfg
+	defer m.api.CloseIdle() // Release keep-alive sockets before the next stage
+
+	validRunIDs := []int{}
+	quarantinedRunIDs := []int{}
+	rejected := make(map[int]string)
+
+	statuses, _ := config.ParseRunStatuses(cfg.MatchStatuses) // Checked by Validate
+	acceptedStatuses := make(map[int]bool, len(statuses))
+	for _, status := range statuses {
+		acceptedStatuses[status] = true
+	}
+	specs, _ := config.ParseValidators(cfg.Validators) // Checked by Validate
+	validators := newValidators(specs, cfg.TimeSkewTolerance)
+
+	if m.cacheDir != "" {
+		if err := os.MkdirAll(m.cacheDir, 0755); err != nil {
+			return nil, nil, fmt.Errorf("creating cache directory: %v", err)
+		}
+	}
+	cacheHits := 0
+
+	// Requests start at a steady DefaultRPS per second by default; the
+	// semaphore only bounds how many slow responses can be outstanding at once
+	semaphore := make(chan struct{}, cfg.StageConcurrency(defaultWorkers))
+	rateLimiter := clk.Tick(time.Second / time.Duration(cfg.StageRPS(DefaultRPS)))
+	transport.UseLimits(cfg.StageRPS(DefaultRPS), cap(semaphore))
 
+	var wg sync.WaitGroup
 	var mu sync.Mutex
 
+	ctx, cancel := cfg.StageContext(ctx, cfg.MatchTimeout)
+	defer cancel()
+	launched := 0
+	// A rejected token fails every lookup; stop at the first one instead of
+	// rejecting every run and passing an empty list on to complete
+	ctx, abort := context.WithCancel(ctx)
+	defer abort()
+	var authErr error
+
+launch:
 	for _, runID := range runIDs {
+		// A cached run needs no request, so it does not wait for the rate limiter
+		cached := m.readCachedRun(runID)
+		if cached != nil {
+			cacheHits++
+		} else {
+			select {
+			case <-ctx.Done():
+				break launch
+			case <-rateLimiter:
+			}
+		}
+		select {
+		case <-ctx.Done():
+			break launch
+		case semaphore <- struct{}{}: // Acquire a slot
+		}
+		// select picks at random when both are ready
+		if ctx.Err() != nil {
+			<-semaphore
+			break launch
+		}
+		launched++
 		wg.Add(1)
-		semaphore <- struct{}{} // Acquire a slot
 		go func(runID int) {
 			defer wg.Done()
-			cases, valid := fetchCasesForRunID(apiToken, projectCode, runID)
-			if valid && validateRunCases(runID, cases, results) {
+			defer func() { <-semaphore }() // Release the slot
+			cases, err := m.fetchCasesForRunID(ctx, runID, acceptedStatuses, cached)
+			if errors.Is(err, transport.ErrUnauthorized) {
 				mu.Lock()
-				validRunIDs = append(validRunIDs, fmt.Sprintf("%d", runID))
+				if authErr == nil {
+					authErr = err
+				}
+				mu.Unlock()
+				abort()
+				return
+			}
+			if err == nil {
+				err = validateRun(m.log, validators, runID, cases, results[runID])
+			}
+			if err == nil {
+				mu.Lock()
+				validRunIDs = append(validRunIDs, runID)
+				mu.Unlock()
+			} else {
+				fmt.Fprintf(m.log, "Rejecting runID %s: %v\n", redact.ID(runID), err)
+				mu.Lock()
+				quarantinedRunIDs = append(quarantinedRunIDs, runID)
+				rejected[runID] = err.Error()
 				mu.Unlock()
 			}
-			time.Sleep(200 * time.Millisecond) // Maintain rate limit
-			<-semaphore                        // Release a slot
 		}(runID)
 	}
 
 	wg.Wait()
-	writeValidRunIDs("final.txt", validRunIDs)
-}
+	if authErr != nil {
+		return nil, nil, fmt.Errorf("looking up runs: %w", authErr)
+	}
+	resultorder.WarnUnparseable(m.log, "match")
+	retry.ReportBudget(m.log, "match")
+	if cacheHits > 0 {
+		fmt.Fprintf(m.log, "Used cached lookups from %s for %d runs\n", m.cacheDir, cacheHits)
+	}
 
-func readRunIDs(filename string) []int {
-	content, err := os.ReadFile(filename)
-	if err != nil {
-		fmt.Println("Error reading file:", err)
-		return nil
+	// Unchecked runs are left out of final.txt and picked up by the next run
+	if remaining := len(runIDs) - launched; remaining > 0 {
+		m.errs.Warnf("match", "", "%s Match %s, %d runs were not checked", mark.Time, config.StopReason(ctx), remaining)
 	}
-	fmt.Printf("Contents of %s: %s\n", filename, string(content))
 
-	parts := strings.Split(strings.TrimSpace(string(content)), ",")
-	var runIDs []int
-	for _, part := range parts {
-		var id int
-		fmt.Sscanf(part, "%d", &id)
-		runIDs = append(runIDs, id)
+	if cfg.QuarantineFile != "" {
+		if err := m.writeQuarantinedRunIDs(cfg.QuarantineFile, quarantinedRunIDs); err != nil {
+			return nil, nil, err
+		}
 	}
-	fmt.Printf("Parsed Run IDs: %v\n", runIDs)
-	return runIDs
+	return validRunIDs, rejected, nil
 }
 
-func fetchCasesForRunID(apiToken, projectCode string, runID int) ([]int, bool) {
-	url := fmt.Sprintf("https://api.qase.io/v1/run/%s/%d?include=cases", projectCode, runID)
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Add("accept", "application/json")
-	req.Header.Add("Token", apiToken)
-
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		fmt.Printf("API request failed for runID %d: %v\n", runID, err)
-		return nil, false
+// reportValidation prints the outcome of every run for --validate-only
+func (m *Matcher) reportValidation(validRunIDs []int, rejected map[int]string) {
+	sort.Ints(validRunIDs)
+	rejectedIDs := make([]int, 0, len(rejected))
+	for id := range rejected {
+		rejectedIDs = append(rejectedIDs, id)
 	}
-	defer res.Body.Close()
+	sort.Ints(rejectedIDs)
 
-	body, _ := io.ReadAll(res.Body)
-	fmt.Printf("API Response for runID %d: %s\n", runID, string(body))
-
-	var apiResp APIResponse
-	if err := json.Unmarshal(body, &apiResp); err != nil {
-		fmt.Printf("Error parsing JSON response for runID %d: %v\n", runID, err)
-		return nil, false
+	fmt.Fprintf(m.log, "\nValidation preview: %d valid, %d invalid\n", len(validRunIDs), len(rejectedIDs))
+	for _, id := range validRunIDs {
+		fmt.Fprintf(m.log, "  %s %s\n", mark.OK, redact.ID(id))
+	}
+	for _, id := range rejectedIDs {
+		fmt.Fprintf(m.log, "  %s %s: %s\n", mark.Fail, redact.ID(id), rejected[id])
 	}
+}
 
-	if !apiResp.Status || apiResp.Result.Status != 0 {
-		fmt.Printf("Invalid API response for runID %d (Status: %d)\n", runID, apiResp.Result.Status)
-		return nil, false
+func (m *Matcher) readRunIDs(filename, format string) ([]int, error) {
+	content, err := stdio.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading file: %v", err)
+	}
+	if !redact.Enabled() {
+		verbose.Fprintf(m.log, "Contents of %s: %s\n", filename, string(content))
 	}
 
-	return apiResp.Result.Cases, true
+	runIDs, err := runids.Parse(content, format, m.log)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", filename, err)
+	}
+	verbose.Fprintf(m.log, "Parsed Run IDs: %s\n", redact.IDs(runIDs))
+	if len(runIDs) == 0 {
+		fmt.Fprintf(m.log, "%s lists no run IDs\n", filename)
+	}
+	return runIDs, nil
 }
 
-func readResults(filename string) []TestResult {
-	file, err := os.Open(filename)
-	if err != nil {
-		fmt.Println("Error opening results file:", err)
-		return nil
+// describeRunStatus explains a run status code in rejection messages
+func describeRunStatus(status int) string {
+	switch status {
+	case config.RunStatuses["active"]:
+		return "run in progress"
+	case config.RunStatuses["complete"]:
+		return "run already complete"
+	case config.RunStatuses["abort"]:
+		return "run aborted"
+	default:
+		return fmt.Sprintf("unexpected status %d", status)
 	}
-	defer file.Close()
+}
 
-	var results []TestResult
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		var result TestResult
-		if err := json.Unmarshal([]byte(scanner.Text()), &result); err == nil {
-			results = append(results, result)
-		} else {
-			fmt.Printf("Error parsing test result JSON: %s\n", scanner.Text())
+// fetchCasesForRunID returns the case IDs of a run, or an error explaining why
+// the run cannot be matched. A cached lookup is used instead of the API when
+// there is one.
+func (m *Matcher) fetchCasesForRunID(ctx context.Context, runID int, acceptedStatuses map[int]bool, cached *runInfo) ([]int, error) {
+	info := cached
+	if info == nil {
+		var err error
+		if info, err = m.fetchRun(ctx, runID); err != nil {
+			return nil, err
 		}
 	}
-	fmt.Printf("Total test results read: %d\n", len(results))
-	return results
+	if !acceptedStatuses[info.Status] {
+		return nil, fmt.Errorf("%s", describeRunStatus(info.Status))
+	}
+	return info.Cases, nil
 }
 
-func validateRunCases(runID int, caseIDs []int, results []TestResult) bool {
-	fmt.Printf("Validating runID: %d with expected cases: %v\n", runID, caseIDs)
+// fetchRun looks a run up through the API, retrying transient failures, and
+// caches the result
+func (m *Matcher) fetchRun(ctx context.Context, runID int) (*runInfo, error) {
+	run, err := m.api.GetRun(ctx, m.cfg.ProjectCode, runID, true)
+	if err != nil {
+		return nil, apiFailure(runID, err)
+	}
+
+	info := &runInfo{Status: run.Status, Cases: run.Cases, FetchedAt: clk.Now()}
+	m.writeCachedRun(runID, info)
+	return info, nil
+}
 
-	foundCases := make(map[int]int)
-	latestPassTime := make(map[int]string)
-	passedCases := make(map[int]bool)
+// apiFailure records a failed run lookup in the error report. Runs rejected
+// for their status or results are decisions, not errors, and are not recorded.
+func apiFailure(runID int, err error) error {
+	errreport.Record(errreport.Error, "match", "run="+redact.ID(runID), err.Error())
+	return err
+}
 
-	for _, result := range results {
-		if result.RunID == runID {
-			foundCases[result.CaseID]++
-			if result.Status == "passed" {
-				passedCases[result.CaseID] = true
-				if latestPassTime[result.CaseID] == "" || result.EndTime > latestPassTime[result.CaseID] {
-					latestPassTime[result.CaseID] = result.EndTime
-				}
+// readResults reads the results file in a single pass, grouping the results by
+// run ID so each run is validated against its own results only
+func (m *Matcher) readResults(filename string) (map[int][]resultsfile.Result, error) {
+	results := make(map[int][]resultsfile.Result)
+	total, missingRunID := 0, 0
+	err := resultsfile.Each(filename, func(line []byte) {
+		if result, ok := m.parseResult(line); ok {
+			if result.RunID == 0 {
+				missingRunID++
+				return
 			}
+			results[result.RunID] = append(results[result.RunID], result)
+			total++
 		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading results file: %v", err)
+	}
+	m.warnMissingRunID(missingRunID)
+	fmt.Fprintf(m.log, "Total test results read: %d\n", total)
+	return results, nil
+}
+
+// warnMissingRunID reports result rows skipped for lacking a run_id, which
+// would otherwise form a phantom run 0
+func (m *Matcher) warnMissingRunID(count int) {
+	if count > 0 {
+		m.errs.Warnf("match", "", "%s Skipped %d results without a run_id", mark.Warn, count)
 	}
+}
 
-	for _, result := range results {
-		if result.RunID == runID && result.Status != "passed" {
-			if latestPassTime[result.CaseID] != "" && result.EndTime > latestPassTime[result.CaseID] {
-				fmt.Printf("RunID %d failed validation: Case %d has a non-passed result (%s) after latest pass at %s\n",
-					runID, result.CaseID, result.Status, latestPassTime[result.CaseID])
-				return false
-			}
-		}
+func (m *Matcher) parseResult(line []byte) (resultsfile.Result, bool) {
+	var result resultsfile.Result
+	if err := json.Unmarshal(line, &result); err != nil {
+		m.errs.Errorf("match", "", "Error parsing test result JSON: %s", line)
+		return result, false
 	}
+	return result, true
+}
+
+// orderEntry describes a result at position pos of the results, which are
+// kept in input order
+func orderEntry(result resultsfile.Result, pos int) resultorder.Entry {
+	return resultorder.Entry{EndTime: result.EndTime, Status: result.Status, Pos: pos}
+}
 
-	fmt.Printf("RunID %d is valid\n", runID)
-	return true
+func (m *Matcher) writeValidRunIDs(filename string, runIDs []int) error {
+	fmt.Fprintf(m.log, "Writing %d valid runIDs to %s\n", len(runIDs), filename)
+	verbose.Fprintf(m.log, "Final list of valid runIDs to be written: %s\n", redact.IDs(runIDs))
+	if err := runids.Write(filename, runIDs, m.cfg.RunsFileFormat); err != nil {
+		return fmt.Errorf("writing to file %s: %v", filename, err)
+	}
+	if err := runids.WriteMeta(filename, m.cfg.ProjectCode); err != nil {
+		return fmt.Errorf("writing project stamp for %s: %v", filename, err)
+	}
+	return nil
 }
 
-func writeValidRunIDs(filename string, runIDs []string) {
-	fmt.Printf("Final list of valid runIDs to be written: %v\n", runIDs)
-	content := strings.Join(runIDs, ",")
-	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
-		fmt.Printf("Error writing to file %s: %v\n", filename, err)
+// writeQuarantinedRunIDs records the run IDs that match excluded so they can be
+// investigated and fed back into a later run
+func (m *Matcher) writeQuarantinedRunIDs(filename string, runIDs []int) error {
+	sort.Ints(runIDs)
+	fmt.Fprintf(m.log, "Quarantined %d runIDs that failed matching: %s\n", len(runIDs), redact.IDs(runIDs))
+	if err := runids.Write(filename, runIDs, m.cfg.RunsFileFormat); err != nil {
+		return fmt.Errorf("writing to file %s: %v", filename, err)
 	}
+	return nil
 }
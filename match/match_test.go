@@ -0,0 +1,266 @@
+package match
+
+import (
+	"bytes"
+	"complete_run/clock"
+	"complete_run/config"
+	"complete_run/errreport"
+	"complete_run/qase"
+	"complete_run/resultsfile"
+	"complete_run/retry"
+	"complete_run/transport"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testMatcher returns a Matcher looking runs up through handler one at a time,
+// without pacing and retrying without waiting
+func testMatcher(t *testing.T, handler http.HandlerFunc) *Matcher {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	cfg, err := config.Defaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.APIToken, cfg.ProjectCode = "token", "DEMO"
+	cfg.RPS, cfg.Concurrency = 1000, 1
+
+	m := New(cfg, qase.New(srv.URL, "token", srv.Client()), io.Discard)
+	reads := retry.Reads
+	retry.Reads.InitialDelay, retry.Reads.MaxDelay = time.Millisecond, time.Millisecond
+	t.Cleanup(func() { retry.Reads = reads })
+	return m
+}
+
+// runServer answers the nth run lookup with statuses[n], repeating the last
+// status once they run out. A 200 describes an active run with case 1.
+func runServer(requests *atomic.Int32, statuses ...int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1)) - 1
+		status := statuses[min(n, len(statuses)-1)]
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		io.WriteString(w, `{"status":true,"result":{"id":1,"status":0,"cases":[1]}}`)
+	}
+}
+
+// passedLines returns a passed result of case 1 for each run
+func passedLines(runIDs ...int) [][]byte {
+	var lines [][]byte
+	for _, id := range runIDs {
+		lines = append(lines, []byte(fmt.Sprintf(`{"run_id":%d,"case_id":1,"status":"passed","end_time":"2024-03-01T12:00:00Z"}`, id)))
+	}
+	return lines
+}
+
+func TestMatchRetriesServerErrors(t *testing.T) {
+	var requests atomic.Int32
+	m := testMatcher(t, runServer(&requests, http.StatusInternalServerError, http.StatusOK))
+
+	valid, err := m.MatchInMemory(context.Background(), []int{1}, passedLines(1))
+	if err != nil {
+		t.Fatalf("MatchInMemory failed: %v", err)
+	}
+	if len(valid) != 1 || requests.Load() != 2 {
+		t.Errorf("%d valid runs after %d requests, want 1 after 2", len(valid), requests.Load())
+	}
+}
+
+func TestMatchAbortsOnRejectedToken(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		var requests atomic.Int32
+		m := testMatcher(t, runServer(&requests, status))
+
+		valid, err := m.MatchInMemory(context.Background(), []int{1, 2, 3}, passedLines(1, 2, 3))
+		if !errors.Is(err, transport.ErrUnauthorized) {
+			t.Errorf("HTTP %d: err = %v, want ErrUnauthorized", status, err)
+		}
+		// Neither retried nor followed by lookups of the other runs
+		if len(valid) != 0 || requests.Load() != 1 {
+			t.Errorf("HTTP %d: %d valid runs after %d requests, want none after 1", status, len(valid), requests.Load())
+		}
+	}
+}
+
+func TestMatchPacesLookups(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	defer func(c clock.Clock) { clk = c }(clk)
+	clk = fake
+
+	var mu sync.Mutex
+	var sent []time.Time
+	m := testMatcher(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sent = append(sent, fake.Now())
+		mu.Unlock()
+		io.WriteString(w, `{"status":true,"result":{"id":1,"status":0,"cases":[1]}}`)
+	})
+	// The default rate, with more than one lookup allowed in flight
+	m.cfg.RPS, m.cfg.Concurrency = 0, 0
+
+	const runs = 10
+	runIDs := make([]int, runs)
+	for i := range runIDs {
+		runIDs[i] = i + 1
+	}
+	done := make(chan error)
+	go func() {
+		_, err := m.MatchInMemory(context.Background(), runIDs, passedLines(runIDs...))
+		done <- err
+	}()
+
+	// Move fake time along in small steps until the match is done
+	for finished := false; !finished; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("MatchInMemory failed: %v", err)
+			}
+			finished = true
+		default:
+			fake.Advance(10 * time.Millisecond)
+			time.Sleep(50 * time.Microsecond)
+		}
+	}
+
+	if len(sent) != runs {
+		t.Fatalf("%d lookups, want %d", len(sent), runs)
+	}
+	// The nth lookup cannot start before the nth tick of the rate limiter
+	sort.Slice(sent, func(i, j int) bool { return sent[i].Before(sent[j]) })
+	for i, at := range sent {
+		if want := time.Duration(i+1) * time.Second / DefaultRPS; at.Sub(start) < want {
+			t.Errorf("lookup %d sent after %v of fake time, want at least %v", i+1, at.Sub(start), want)
+		}
+	}
+}
+
+// benchmarkResults writes a results file of perRun results for each of runs
+// runs, interleaved as the API lists them, and returns its path
+func benchmarkResults(b *testing.B, runs, perRun int) string {
+	b.Helper()
+	var lines []byte
+	for i := 0; i < perRun; i++ {
+		for runID := 1; runID <= runs; runID++ {
+			lines = fmt.Appendf(lines, `{"run_id":%d,"case_id":%d,"status":"passed","end_time":"2024-03-01T12:00:00Z"}`+"\n", runID, i+1)
+		}
+	}
+	path := filepath.Join(b.TempDir(), "results.json")
+	if err := os.WriteFile(path, lines, 0644); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+// BenchmarkRunResults compares finding the results of every run in the map
+// readResults builds with scanning the whole result list once per run, as
+// match did before grouping
+func BenchmarkRunResults(b *testing.B) {
+	const runs, perRun = 2000, 20
+	path := benchmarkResults(b, runs, perRun)
+	m := &Matcher{log: io.Discard, errs: errreport.To(io.Discard)}
+
+	b.Run("grouped", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			results, err := m.readResults(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for runID := 1; runID <= runs; runID++ {
+				if len(results[runID]) != perRun {
+					b.Fatalf("run %d has %d results", runID, len(results[runID]))
+				}
+			}
+		}
+	})
+
+	b.Run("scanned", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			results, err := m.readResults(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var all []resultsfile.Result
+			for _, runResults := range results {
+				all = append(all, runResults...)
+			}
+			for runID := 1; runID <= runs; runID++ {
+				var own []resultsfile.Result
+				for _, result := range all {
+					if result.RunID == runID {
+						own = append(own, result)
+					}
+				}
+				if len(own) != perRun {
+					b.Fatalf("run %d has %d results", runID, len(own))
+				}
+			}
+		}
+	})
+}
+
+func TestLatestPassedIdenticalTimestamps(t *testing.T) {
+	at := func(status string) resultsfile.Result {
+		return resultsfile.Result{RunID: 1, CaseID: 1, Status: status, EndTime: "2024-03-01T12:00:00Z"}
+	}
+	tests := []struct {
+		name    string
+		results []resultsfile.Result
+		ok      bool
+	}{
+		// A failure at the same second as a pass wins, whichever is listed last,
+		// as in filter
+		{"pass listed last", []resultsfile.Result{at("failed"), at("passed")}, false},
+		{"failure listed last", []resultsfile.Result{at("passed"), at("failed")}, false},
+		{"two passes", []resultsfile.Result{at("passed"), at("passed")}, true},
+	}
+	for _, test := range tests {
+		if ok, reason := (latestPassed{}).Validate(1, []int{1}, test.results); ok != test.ok {
+			t.Errorf("%s: valid %v (%s), want %v", test.name, ok, reason, test.ok)
+		}
+	}
+}
+
+func TestReadResultsSkipsRowsWithoutRunID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.json")
+	content := `{"run_id":1,"case_id":1,"status":"passed"}
+{"case_id":2,"status":"failed"}
+{"run_id":0,"case_id":3,"status":"failed"}
+{"run_id":1,"case_id":4,"status":"passed"}
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var log bytes.Buffer
+	m := &Matcher{log: &log, errs: errreport.To(&log)}
+
+	results, err := m.readResults(path)
+	if err != nil {
+		t.Fatalf("readResults failed: %v", err)
+	}
+	if _, ok := results[0]; ok || len(results[1]) != 2 {
+		t.Errorf("grouped results %v, want 2 of run 1 and no run 0", results)
+	}
+	for _, want := range []string{"Skipped 2 results without a run_id", "Total test results read: 2"} {
+		if !strings.Contains(log.String(), want) {
+			t.Errorf("log %q does not say %q", log.String(), want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package match
+
+import (
+	"complete_run/config"
+	"complete_run/redact"
+	"complete_run/resultorder"
+	"complete_run/resultsfile"
+	"complete_run/verbose"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Validator is one rule deciding whether a run may be completed. cases are the
+// run's case IDs from the API and results are the run's results in input
+// order. A run is rejected with reason when ok is false.
+type Validator interface {
+	Validate(runID int, cases []int, results []resultsfile.Result) (ok bool, reason string)
+}
+
+// newValidators builds the chain of validators selected by --validators
+func newValidators(specs []config.ValidatorSpec, skewTolerance time.Duration) []Validator {
+	validators := make([]Validator, 0, len(specs))
+	for _, spec := range specs {
+		switch spec.Name {
+		case "latest-passed":
+			validators = append(validators, latestPassed{skewTolerance: skewTolerance})
+		case "all-cases-present":
+			validators = append(validators, allCasesPresent{})
+		case "no-flaky":
+			validators = append(validators, noFlaky{})
+		case "min-pass-rate":
+			validators = append(validators, minPassRate{rate: spec.Arg, skewTolerance: skewTolerance})
+		}
+	}
+	return validators
+}
+
+// validateRun runs the run's results through every validator in turn and
+// returns the first rejection, if any. A valid run is logged to log.
+func validateRun(log io.Writer, validators []Validator, runID int, cases []int, runResults []resultsfile.Result) error {
+	verbose.Fprintf(log, "Validating runID: %s with expected cases: %s\n", redact.ID(runID), redact.IDs(cases))
+
+	for _, validator := range validators {
+		if ok, reason := validator.Validate(runID, cases, runResults); !ok {
+			return fmt.Errorf("failed validation: %s", reason)
+		}
+	}
+
+	fmt.Fprintf(log, "RunID %s is valid\n", redact.ID(runID))
+	return nil
+}
+
+// latestCaseResults returns the latest result of every case, ordered as
+// described in resultorder.Later
+func latestCaseResults(results []resultsfile.Result, skewTolerance time.Duration) map[int]resultorder.Entry {
+	latest := make(map[int]resultorder.Entry)
+	for i, result := range results {
+		entry := orderEntry(result, i)
+		if current, ok := latest[result.CaseID]; !ok || resultorder.Later(current, entry, skewTolerance) {
+			latest[result.CaseID] = entry
+		}
+	}
+	return latest
+}
+
+// latestPassed rejects a run if a case that passed has a non-passed result at
+// or after its latest pass. This is the default rule.
+type latestPassed struct {
+	skewTolerance time.Duration
+}
+
+func (v latestPassed) Validate(runID int, cases []int, results []resultsfile.Result) (bool, string) {
+	latestPass := make(map[int]resultorder.Entry)
+	passedCases := make(map[int]bool)
+
+	for i, result := range results {
+		if result.Status == "passed" {
+			entry := orderEntry(result, i)
+			if !passedCases[result.CaseID] || resultorder.Later(latestPass[result.CaseID], entry, v.skewTolerance) {
+				latestPass[result.CaseID] = entry
+			}
+			passedCases[result.CaseID] = true
+		}
+	}
+
+	for i, result := range results {
+		if result.Status != "passed" && passedCases[result.CaseID] {
+			// Ordered like filter, so a non-passed result at the same end_time as
+			// the latest pass counts as after it
+			if resultorder.Later(latestPass[result.CaseID], orderEntry(result, i), v.skewTolerance) {
+				return false, fmt.Sprintf("case %s has a non-passed result (%s) at or after latest pass at %s",
+					redact.ID(result.CaseID), result.Status, latestPass[result.CaseID].EndTime)
+			}
+		}
+	}
+	return true, ""
+}
+
+// allCasesPresent rejects a run if one of its cases has no result at all
+type allCasesPresent struct{}
+
+func (allCasesPresent) Validate(runID int, cases []int, results []resultsfile.Result) (bool, string) {
+	found := make(map[int]bool)
+	for _, result := range results {
+		found[result.CaseID] = true
+	}
+	missing := 0
+	for _, caseID := range cases {
+		if !found[caseID] {
+			missing++
+		}
+	}
+	if missing > 0 {
+		return false, fmt.Sprintf("%d of %d cases have no results", missing, len(cases))
+	}
+	return true, ""
+}
+
+// noFlaky rejects a run if any case has both passed and non-passed results
+type noFlaky struct{}
+
+func (noFlaky) Validate(runID int, cases []int, results []resultsfile.Result) (bool, string) {
+	passed := make(map[int]bool)
+	failed := make(map[int]bool)
+	for _, result := range results {
+		if result.Status == "passed" {
+			passed[result.CaseID] = true
+		} else {
+			failed[result.CaseID] = true
+		}
+	}
+	for caseID := range passed {
+		if failed[caseID] {
+			return false, fmt.Sprintf("case %s is flaky (both passed and non-passed results)", redact.ID(caseID))
+		}
+	}
+	return true, ""
+}
+
+// minPassRate rejects a run if less than rate of its cases have a passed latest
+// result. Cases without results count as not passed.
+type minPassRate struct {
+	rate          float64
+	skewTolerance time.Duration
+}
+
+func (v minPassRate) Validate(runID int, cases []int, results []resultsfile.Result) (bool, string) {
+	if len(cases) == 0 {
+		return true, ""
+	}
+	latest := latestCaseResults(results, v.skewTolerance)
+	passed := 0
+	for _, caseID := range cases {
+		if entry, ok := latest[caseID]; ok && entry.Status == "passed" {
+			passed++
+		}
+	}
+	if rate := float64(passed) / float64(len(cases)); rate < v.rate {
+		return false, fmt.Sprintf("pass rate %.1f%% (%d of %d cases) is below %.1f%%",
+			rate*100, passed, len(cases), v.rate*100)
+	}
+	return true, ""
+}
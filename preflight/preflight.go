@@ -0,0 +1,120 @@
+package preflight
+
+import (
+	"complete_run/config"
+	"complete_run/stdio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Check looks for problems with local files that would otherwise only show up
+// halfway through a run, after API calls were already spent. It makes no
+// network requests. Every problem found is returned, not just the first.
+func Check(cfg *config.Config) []error {
+	var problems []error
+	if err := checkWritable("."); err != nil {
+		problems = append(problems, fmt.Errorf("working directory is not writable: %v", err))
+	}
+
+	// Inputs that no earlier stage produces must already exist
+	if !cfg.CompleteAll && !cfg.ListInProgress && len(cfg.RunIDs) == 0 {
+		for _, pattern := range strings.Split(cfg.ResultsGlob, ",") {
+			pattern = strings.TrimSpace(pattern)
+			if pattern == "" || pattern == stdio.Name || producedByFetch(pattern, cfg.ResultsFile()) {
+				continue
+			}
+			if matches, err := filepath.Glob(pattern); err != nil || len(matches) == 0 {
+				problems = append(problems, fmt.Errorf("--results-glob: no files match %q; check the pattern or leave it empty to read %s", pattern, cfg.ResultsFile()))
+			}
+		}
+		if cfg.DiffFiltered != "" && cfg.DiffFiltered != stdio.Name {
+			if _, err := os.Stat(cfg.DiffFiltered); err != nil {
+				problems = append(problems, fmt.Errorf("--diff-filtered: %s not found; pass the filtered.txt kept from an earlier run", cfg.DiffFiltered))
+			}
+		}
+	}
+	// A stage command reads what an earlier invocation of the stage before it wrote
+	var inputs []struct{ flag, path, producer string }
+	switch {
+	case cfg.Command == config.CommandFilter && cfg.ResultsGlob == "":
+		inputs = append(inputs, struct{ flag, path, producer string }{"--results-file", cfg.ResultsFile(), config.CommandFetch})
+	case cfg.Command == config.CommandMatch:
+		inputs = append(inputs,
+			struct{ flag, path, producer string }{"--filtered-file", cfg.FilteredPath, config.CommandFilter},
+			struct{ flag, path, producer string }{"--results-file", cfg.ResultsFile(), config.CommandFetch},
+		)
+	case cfg.Command == config.CommandComplete && len(cfg.RunIDs) == 0 && len(cfg.ByTitle) == 0 && len(cfg.ByKey) == 0 && cfg.RetryFailed == "":
+		inputs = append(inputs, struct{ flag, path, producer string }{"--final-file", cfg.FinalPath, config.CommandMatch})
+	}
+	for _, input := range inputs {
+		if input.path == stdio.Name {
+			continue
+		}
+		if _, err := os.Stat(input.path); err != nil {
+			problems = append(problems, fmt.Errorf("%s: %s not found; run the %s command first", input.flag, input.path, input.producer))
+		}
+	}
+	if cfg.RetryFailed != "" {
+		if _, err := os.Stat(cfg.RetryFailed); err != nil {
+			problems = append(problems, fmt.Errorf("--retry-failed: %s not found; pass the --failed-file output of an earlier run", cfg.RetryFailed))
+		}
+	}
+
+	// Output files can be created later, but their directories must exist now
+	outputs := []struct{ flag, path string }{
+		{"--quarantine-file", cfg.QuarantineFile},
+		{"--fetch-report", cfg.FetchReport},
+		{"--filter-events", cfg.FilterEvents},
+		{"--checkpoint-file", cfg.CheckpointFile},
+		{"--error-report", cfg.ErrorReport},
+		{"--failed-file", cfg.FailedFile},
+		{"--complete-report", cfg.CompleteReport},
+		{"--errors-file", cfg.ErrorsPath},
+	}
+	if !cfg.CompleteAll && !cfg.ListInProgress && !cfg.InMemory && len(cfg.RunIDs) == 0 {
+		outputs = append(outputs,
+			struct{ flag, path string }{"--results-file", cfg.ResultsFile()},
+			struct{ flag, path string }{"--filtered-file", cfg.FilteredPath},
+			struct{ flag, path string }{"--final-file", cfg.FinalPath},
+		)
+	}
+	if cfg.ListInProgress {
+		outputs = append(outputs, struct{ flag, path string }{"--list-output", cfg.ListOutput})
+	}
+	if cfg.OnlyNew {
+		outputs = append(outputs, struct{ flag, path string }{"--state-file", cfg.StateFile})
+	}
+	for _, output := range outputs {
+		if output.path == "" || output.path == stdio.Name {
+			continue
+		}
+		if dir := filepath.Dir(output.path); !isDir(dir) {
+			problems = append(problems, fmt.Errorf("%s: directory %s does not exist; create it or choose another path", output.flag, dir))
+		}
+	}
+	return problems
+}
+
+// producedByFetch reports whether pattern matches the results file fetch
+// writes, which does not exist yet before the pipeline runs
+func producedByFetch(pattern, resultsFile string) bool {
+	matched, err := filepath.Match(pattern, resultsFile)
+	return err == nil && matched
+}
+
+// checkWritable creates and removes a scratch file in dir
+func checkWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".preflight-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
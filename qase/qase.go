@@ -0,0 +1,346 @@
+package qase
+
+import (
+	"bytes"
+	"complete_run/curl"
+	"complete_run/endpoint"
+	"complete_run/redact"
+	"complete_run/retry"
+	"complete_run/transport"
+	"complete_run/verbose"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Client sends requests to the Qase API with one token. Stages are handed one,
+// so a test can point them at an httptest.Server.
+type Client struct {
+	baseURL string // Versioned base URL; empty uses the endpoint package's
+	token   string
+	http    transport.HTTPDoer
+	log     io.Writer // Retry, curl and --verbose lines; nil is stdout
+}
+
+// New returns a client sending requests through httpClient, usually an
+// *http.Client. An empty baseURL uses api.qase.io or QASE_API_BASE_URL, with
+// the configured API version.
+func New(baseURL, token string, httpClient transport.HTTPDoer) *Client {
+	return &Client{baseURL: strings.TrimRight(baseURL, "/"), token: token, http: httpClient}
+}
+
+// Default returns a client for token on the configured endpoint, sending
+// through transport.Tracked with the request timeout of retry.Reads
+func Default(token string) *Client {
+	return New("", token, &http.Client{
+		Transport: transport.Tracked,
+		Timeout:   retry.Reads.RequestTimeout,
+	})
+}
+
+// WithLog returns a copy of c that logs to w
+func (c *Client) WithLog(w io.Writer) *Client {
+	copy := *c
+	copy.log = w
+	return &copy
+}
+
+// CloseIdle releases the client's idle keep-alive connections, so a finished
+// stage does not hold sockets open while the next one runs
+func (c *Client) CloseIdle() {
+	transport.CloseIdle(c.http)
+}
+
+func (c *Client) logs() io.Writer {
+	if c.log == nil {
+		return os.Stdout
+	}
+	return c.log
+}
+
+// ErrNotFound is wrapped by the error of a lookup the API answered with 404
+var ErrNotFound = errors.New("not found")
+
+// Run is a test run as listed or looked up. Cases is only filled by GetRun
+// with includeCases.
+type Run struct {
+	ID        int    `json:"id"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	StartTime string `json:"start_time"`
+	Cases     []int  `json:"cases,omitempty"`
+}
+
+// RunList is one page of the run list
+type RunList struct {
+	Total    int   `json:"total"`
+	Filtered int   `json:"filtered"`
+	Count    int   `json:"count"`
+	Entities []Run `json:"entities"`
+}
+
+// RunQuery selects a page of the run list, optionally narrowed by a title
+// search
+type RunQuery struct {
+	Search string
+	Limit  int
+	Offset int
+}
+
+// ResultPage is one page of the result list. HasTotal is false when the
+// response carried no total, as bare arrays never do; Total is 0 then. Size is
+// the length of the response body, for callers bounding the memory held by
+// fetched pages.
+type ResultPage struct {
+	Total    int                      `json:"total"`
+	Filtered int                      `json:"filtered"`
+	Count    int                      `json:"count"`
+	Entities []map[string]interface{} `json:"entities"`
+	HasTotal bool                     `json:"-"`
+	Size     int64                    `json:"-"`
+}
+
+// Completion is the outcome of a completion request. HTTPStatus is the status
+// of the last response, 0 if none was received. Body is the response body of
+// a successful request, for the caller to interpret.
+type Completion struct {
+	HTTPStatus int
+	Attempts   int
+	Body       []byte
+}
+
+func (c *Client) url(format string, args ...interface{}) string {
+	if c.baseURL != "" {
+		return c.baseURL + fmt.Sprintf(format, args...)
+	}
+	return endpoint.URL(format, args...)
+}
+
+// newRequest builds an API request and prints it as curl once per kind
+func (c *Client) newRequest(method, url, kind string, body []byte) (*http.Request, error) {
+	var payload io.Reader
+	if body != nil {
+		payload = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, payload)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %v", err)
+	}
+	req.Header.Add("accept", "application/json")
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	req.Header.Add("Token", c.token)
+	curl.Fprint(c.logs(), kind, req)
+	return retry.WithLog(req, c.logs()), nil
+}
+
+// getJSON sends a GET through retry.Reads and decodes the "result" of a
+// response with "status": true into result
+func (c *Client) getJSON(ctx context.Context, url, kind, op string, result interface{}) error {
+	req, err := c.newRequest("GET", url, kind, nil)
+	if err != nil {
+		return err
+	}
+	req = retry.WithOp(req, op)
+
+	resp, _, err := retry.Do(ctx, c.http, req, retry.Reads)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return fmt.Errorf("HTTP 404: %w", ErrNotFound)
+	}
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return fmt.Errorf("API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading response: %v", err)
+	}
+	if !redact.Enabled() {
+		verbose.Fprintf(c.logs(), "API response for %s: %s\n", op, body)
+	}
+
+	apiResp := struct {
+		Status bool        `json:"status"`
+		Result interface{} `json:"result"`
+	}{Result: result}
+	if err := json.Unmarshal(body, &apiResp); err != nil {
+		return fmt.Errorf("parsing JSON response: %v", err)
+	}
+	if !apiResp.Status {
+		return errors.New("API response status is false")
+	}
+	return nil
+}
+
+// GetRun looks a run up, with its case IDs when includeCases is set
+func (c *Client) GetRun(ctx context.Context, projectCode string, runID int, includeCases bool) (*Run, error) {
+	url := c.url("/run/%s/%d", projectCode, runID)
+	if includeCases {
+		url += "?include=cases"
+	}
+	var run Run
+	if err := c.getJSON(ctx, url, "run-get", "run="+redact.ID(runID), &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// ListRuns fetches one page of the run list
+func (c *Client) ListRuns(ctx context.Context, projectCode string, query RunQuery) (*RunList, error) {
+	kind, op := "run-list", fmt.Sprintf("list offset=%d", query.Offset)
+	path := c.url("/run/%s?limit=%d&offset=%d", projectCode, query.Limit, query.Offset)
+	if query.Search != "" {
+		kind, op = "run-search", fmt.Sprintf("search offset=%d", query.Offset)
+		path = c.url("/run/%s?search=%s&limit=%d&offset=%d", projectCode, url.QueryEscape(query.Search), query.Limit, query.Offset)
+	}
+	var list RunList
+	if err := c.getJSON(ctx, path, kind, op, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// GetResults fetches one page of the result list through retry.Reads. params
+// holds extra URL parameters starting with &. A page that still fails is left
+// to the caller to account for.
+func (c *Client) GetResults(ctx context.Context, projectCode string, limit, offset int, params string) (*ResultPage, error) {
+	req, err := c.newRequest("GET", c.url("/result/%s?limit=%d&offset=%d%s", projectCode, limit, offset, params), "result-list", nil)
+	if err != nil {
+		return nil, err
+	}
+	req = retry.WithOp(req, fmt.Sprintf("offset=%d", offset))
+
+	// An error page does not decode to results, or decodes to an empty page, so
+	// retry.Do checks the status before the body is read
+	resp, _, err := retry.Do(ctx, c.http, req, retry.Reads)
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, fmt.Errorf("API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %v", err)
+	}
+	page, err := decodeResults(body)
+	if err != nil {
+		return nil, fmt.Errorf("parsing response: %v", err)
+	}
+	page.Size = int64(len(body))
+	return page, nil
+}
+
+// decodeResults decodes a result-list response. Besides the documented
+// {"status":true,"result":{"entities":[...]}} shape it accepts a result that is
+// a bare array and a top-level bare array. Any other shape is reported as an
+// error so an API change fails loudly instead of yielding an empty results.json.
+func decodeResults(body []byte) (*ResultPage, error) {
+	page := &ResultPage{}
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, errors.New("empty response body")
+	}
+
+	if body[0] == '[' {
+		if err := json.Unmarshal(body, &page.Entities); err != nil {
+			return nil, fmt.Errorf("decoding bare entity array: %v", err)
+		}
+		page.Count = len(page.Entities)
+		return page, nil
+	}
+
+	var raw struct {
+		Status *bool           `json:"status"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+	if raw.Status == nil {
+		return nil, errors.New("unexpected response shape: missing \"status\" field")
+	}
+	if !*raw.Status {
+		return nil, errors.New("API response status is false")
+	}
+
+	result := bytes.TrimSpace(raw.Result)
+	switch {
+	case len(result) == 0 || bytes.Equal(result, []byte("null")):
+		return nil, errors.New("unexpected response shape: missing \"result\" field")
+	case result[0] == '[':
+		if err := json.Unmarshal(result, &page.Entities); err != nil {
+			return nil, fmt.Errorf("decoding result array: %v", err)
+		}
+		page.Count = len(page.Entities)
+	case result[0] == '{':
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(result, &fields); err != nil {
+			return nil, err
+		}
+		if _, ok := fields["entities"]; !ok {
+			return nil, errors.New("unexpected response shape: result has no \"entities\" field")
+		}
+		if err := json.Unmarshal(result, page); err != nil {
+			return nil, err
+		}
+		_, page.HasTotal = fields["total"]
+	default:
+		return nil, fmt.Errorf("unexpected response shape: result is %.20s", result)
+	}
+	return page, nil
+}
+
+// CompletionRequest is what CompleteRun sends. Completions are not idempotent
+// on every server, so Retry is usually more conservative than retry.Reads.
+type CompletionRequest struct {
+	Path  string // Path format taking the project code and run ID; empty is /run/%s/%d/complete
+	Body  []byte // JSON request body; nil sends none
+	Retry retry.Config
+}
+
+// CompleteRun marks a run as complete
+func (c *Client) CompleteRun(ctx context.Context, projectCode string, runID int, request CompletionRequest) (Completion, error) {
+	path := request.Path
+	if path == "" {
+		path = "/run/%s/%d/complete"
+	}
+	var completion Completion
+	req, err := c.newRequest("POST", c.url(path, projectCode, runID), "run-complete", request.Body)
+	if err != nil {
+		return completion, err
+	}
+	req = retry.WithOp(req, "run="+redact.ID(runID))
+
+	resp, attempts, err := retry.Do(ctx, c.http, req, request.Retry)
+	completion.Attempts = attempts
+	if resp != nil {
+		completion.HTTPStatus = resp.StatusCode
+	}
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return completion, fmt.Errorf("API request failed after retries: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if completion.Body, err = io.ReadAll(resp.Body); err != nil {
+		return completion, fmt.Errorf("reading response: %v", err)
+	}
+	return completion, nil
+}
@@ -0,0 +1,144 @@
+package qase
+
+import (
+	"complete_run/retry"
+	"complete_run/transport"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testServer answers the nth request with statuses[n] and body, repeating the
+// last status once they run out, and returns a client for it
+func testServer(t *testing.T, body string, statuses ...int) (*Client, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1)) - 1
+		if r.Header.Get("Token") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(statuses[min(n, len(statuses)-1)])
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+
+	// Retry without waiting
+	reads := retry.Reads
+	retry.Reads.InitialDelay, retry.Reads.MaxDelay = time.Millisecond, time.Millisecond
+	t.Cleanup(func() { retry.Reads = reads })
+
+	return New(srv.URL, "token", srv.Client()).WithLog(io.Discard), &requests
+}
+
+func TestDecodeResults(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		entities int
+		total    int
+		hasTotal bool
+	}{
+		{"wrapped with total", `{"status":true,"result":{"total":250,"filtered":250,"count":2,"entities":[{"id":1},{"id":2}]}}`, 2, 250, true},
+		{"wrapped with a total of zero", `{"status":true,"result":{"total":0,"entities":[]}}`, 0, 0, true},
+		{"wrapped without total", `{"status":true,"result":{"entities":[{"id":1}]}}`, 1, 0, false},
+		{"result is a bare array", `{"status":true,"result":[{"id":1},{"id":2},{"id":3}]}`, 3, 0, false},
+		{"top-level bare array", ` [{"id":1}] `, 1, 0, false},
+		{"empty bare array", `[]`, 0, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			page, err := decodeResults([]byte(test.body))
+			if err != nil {
+				t.Fatalf("decodeResults failed: %v", err)
+			}
+			if len(page.Entities) != test.entities || page.Total != test.total || page.HasTotal != test.hasTotal {
+				t.Errorf("got %d entities, total %d (reported: %v); want %d, %d (%v)",
+					len(page.Entities), page.Total, page.HasTotal, test.entities, test.total, test.hasTotal)
+			}
+		})
+	}
+}
+
+func TestDecodeResultsRejectsUnknownShapes(t *testing.T) {
+	for _, body := range []string{
+		``,
+		`{"result":{"entities":[]}}`,
+		`{"status":false,"errorMessage":"no access"}`,
+		`{"status":true}`,
+		`{"status":true,"result":{"items":[]}}`,
+		`{"status":true,"result":"ok"}`,
+		`<html>`,
+	} {
+		if page, err := decodeResults([]byte(body)); err == nil {
+			t.Errorf("decodeResults(%q) = %+v, want an error", body, page)
+		}
+	}
+}
+
+func TestGetResultsRetriesServerErrors(t *testing.T) {
+	api, requests := testServer(t, `{"status":true,"result":{"total":1,"entities":[{"id":1}]}}`, 500, 502, 200)
+
+	page, err := api.GetResults(context.Background(), "DEMO", 100, 0, "")
+	if err != nil {
+		t.Fatalf("GetResults failed: %v", err)
+	}
+	if len(page.Entities) != 1 || requests.Load() != 3 {
+		t.Errorf("got %d entities after %d requests, want 1 after 3", len(page.Entities), requests.Load())
+	}
+}
+
+func TestGetResultsGivesUpAfterReadRetries(t *testing.T) {
+	api, requests := testServer(t, "", 500)
+
+	if _, err := api.GetResults(context.Background(), "DEMO", 100, 0, ""); err == nil {
+		t.Fatal("GetResults succeeded against a failing server")
+	}
+	if want := int32(retry.Reads.MaxRetries + 1); requests.Load() != want {
+		t.Errorf("%d requests, want %d", requests.Load(), want)
+	}
+}
+
+func TestGetResultsDoesNotRetryRejectedTokens(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		api, requests := testServer(t, `{"status":false}`, status)
+
+		_, err := api.GetResults(context.Background(), "DEMO", 100, 0, "")
+		if !errors.Is(err, transport.ErrUnauthorized) {
+			t.Errorf("HTTP %d: err = %v, want ErrUnauthorized", status, err)
+		}
+		if requests.Load() != 1 {
+			t.Errorf("HTTP %d: %d requests, want 1", status, requests.Load())
+		}
+	}
+}
+
+func TestGetResultsStopsRetryingWhenContextIsDone(t *testing.T) {
+	api, requests := testServer(t, "", 500)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := api.GetResults(ctx, "DEMO", 100, 0, ""); err == nil {
+		t.Fatal("GetResults succeeded against a failing server")
+	}
+	if requests.Load() != 1 {
+		t.Errorf("%d requests after cancel, want 1", requests.Load())
+	}
+}
+
+func TestGetRunNotFound(t *testing.T) {
+	api, requests := testServer(t, `{"status":false}`, http.StatusNotFound)
+
+	if _, err := api.GetRun(context.Background(), "DEMO", 7, false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("err = %v, want ErrNotFound", err)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("%d requests, want 1", requests.Load())
+	}
+}
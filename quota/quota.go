@@ -0,0 +1,95 @@
+package quota
+
+import (
+	"complete_run/complete"
+	"complete_run/config"
+	"complete_run/fetch"
+	"complete_run/match"
+	"complete_run/qase"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// line is one row of the estimate. Counts marked atMost are upper bounds,
+// because how many runs survive filtering is only known after fetching.
+// lookups are the --skip-completed status lookups, sent in the same rate-limit
+// slot as the completion that follows them, so they add requests but no time.
+type line struct {
+	stage    string
+	requests int
+	lookups  int
+	rps      int
+	atMost   bool
+}
+
+// PrintEstimate prints to w how many API requests the configured mode would
+// make and roughly how long they take at each stage's request rate, without
+// running it. The estimate itself costs one request per fetch partition plus
+// one.
+func PrintEstimate(w io.Writer, cfg *config.Config, api *qase.Client) error {
+	if cfg.APIToken == "" || cfg.ProjectCode == "" {
+		return errors.New("missing API token or project code in environment variables")
+	}
+
+	// Runs given by --run-ids are known up front; nothing is listed or fetched
+	runs := len(cfg.RunIDs)
+	if runs == 0 {
+		var err error
+		if runs, err = complete.New(cfg, api, w).CountRuns(); err != nil {
+			return fmt.Errorf("counting runs: %w", err)
+		}
+	}
+
+	var lines []line
+	switch {
+	case len(cfg.RunIDs) > 0:
+		lines = []line{{stage: "complete", requests: runs, rps: cfg.StageRPS(complete.DefaultRPS)}}
+	case cfg.CompleteAll:
+		lines = []line{
+			{stage: "list runs", requests: (runs + complete.RunPageSize - 1) / complete.RunPageSize, rps: cfg.StageRPS(complete.DefaultAllRPS)},
+			{stage: "complete", requests: runs, rps: cfg.StageRPS(complete.DefaultAllRPS), atMost: true},
+		}
+	default:
+		fetchRequests, err := fetch.New(cfg, api, w).EstimateRequests()
+		if err != nil {
+			return fmt.Errorf("estimating fetch: %w", err)
+		}
+		lines = []line{
+			{stage: "fetch", requests: fetchRequests, rps: cfg.StageRPS(fetch.DefaultRPS)},
+			{stage: "match", requests: runs, rps: cfg.StageRPS(match.DefaultRPS), atMost: true},
+			{stage: "complete", requests: runs, rps: cfg.StageRPS(complete.DefaultRPS), atMost: true},
+		}
+	}
+	if cfg.SkipCompleted {
+		last := &lines[len(lines)-1]
+		last.lookups = last.requests
+	}
+
+	fmt.Fprintln(w, "API quota estimate (retries not included):")
+	total := 0
+	var duration time.Duration
+	for _, l := range lines {
+		d := time.Duration(l.requests) * time.Second / time.Duration(l.rps)
+		fmt.Fprintf(w, "  %-10s %s%d requests, ~%v at %d req/s%s\n", l.stage+":", bound(l.atMost), l.requests+l.lookups, d.Round(time.Second), l.rps, lookups(l.lookups))
+		total += l.requests + l.lookups
+		duration += d
+	}
+	fmt.Fprintf(w, "  %-10s at most %d requests, ~%v\n", "total:", total, duration.Round(time.Second))
+	return nil
+}
+
+func bound(atMost bool) string {
+	if atMost {
+		return "at most "
+	}
+	return ""
+}
+
+func lookups(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%d of them --skip-completed lookups)", n)
+}
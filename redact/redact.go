@@ -0,0 +1,50 @@
+package redact
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	enabled bool
+	salt    []byte
+)
+
+// Enable turns on ID redaction for the rest of the process. IDs are hashed with
+// a random per-process salt, so the same ID always maps to the same token within
+// one invocation but small numeric IDs cannot be recovered by brute force.
+func Enable() {
+	salt = make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		fmt.Println("Error seeding redaction salt:", err)
+	}
+	enabled = true
+}
+
+// ID formats a run or case ID for log output
+func ID(id int) string {
+	if !enabled {
+		return strconv.Itoa(id)
+	}
+	sum := sha256.Sum256(append(salt, strconv.Itoa(id)...))
+	return "#" + hex.EncodeToString(sum[:4])
+}
+
+// IDs formats a list of IDs for log output, like fmt's %v of an []int
+func IDs(ids []int) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = ID(id)
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+// Enabled reports whether redaction is on, for output that cannot be redacted
+// piecemeal and must be suppressed instead
+func Enabled() bool {
+	return enabled
+}
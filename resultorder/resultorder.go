@@ -0,0 +1,96 @@
+package resultorder
+
+import (
+	"complete_run/config"
+	"complete_run/errreport"
+	"complete_run/mark"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Entry is the part of a test result that decides which result of a case
+// came last. Pos is the result's position in the input, i.e. file order.
+type Entry struct {
+	EndTime string
+	Status  string
+	Pos     int
+}
+
+// End times that could not be parsed since the last WarnUnparseable. Later is
+// called from concurrent match workers.
+var (
+	unparseableMutex = &sync.Mutex{}
+	unparseable      = make(map[string]bool)
+)
+
+// Later reports whether b counts as later than a. End times are compared as
+// timestamps, so mixed time zones and fractional seconds order correctly, and
+// the later end_time wins. Results whose end times are identical, or within
+// tolerance of each other since skewed runner clocks make their timestamps
+// unreliable, count as simultaneous and are ordered by tiebreak. So are
+// results whose end_time cannot be parsed, so an unreadable timestamp never
+// lets a pass hide a failure.
+func Later(a, b Entry, tolerance time.Duration) bool {
+	ta, okA := parseEndTime(a.EndTime)
+	tb, okB := parseEndTime(b.EndTime)
+	if !okA || !okB {
+		return tiebreak(a, b)
+	}
+
+	if diff := tb.Sub(ta); diff.Abs() > tolerance {
+		return diff > 0
+	}
+	return tiebreak(a, b)
+}
+
+// tiebreak orders results that count as simultaneous: a non-passed result wins
+// over a passed one, so the decision never depends on iteration order, and
+// among results that both passed or both did not, the later position in the
+// input wins
+func tiebreak(a, b Entry) bool {
+	if (a.Status == "passed") != (b.Status == "passed") {
+		return a.Status == "passed"
+	}
+	return b.Pos > a.Pos
+}
+
+// parseEndTime parses an end_time as RFC3339 (fractional seconds and any
+// offset allowed), Qase's "2006-01-02 15:04:05" or Unix seconds. Failures are
+// remembered for WarnUnparseable.
+func parseEndTime(raw string) (time.Time, bool) {
+	if t, err := config.ParseTime(raw); err == nil {
+		return t, true
+	}
+	if seconds, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.Unix(seconds, 0), true
+	}
+
+	unparseableMutex.Lock()
+	unparseable[raw] = true
+	unparseableMutex.Unlock()
+	return time.Time{}, false
+}
+
+// WarnUnparseable records a warning for stage, logged to w, if end times could
+// not be parsed since the last call, and forgets them
+func WarnUnparseable(w io.Writer, stage string) {
+	unparseableMutex.Lock()
+	defer unparseableMutex.Unlock()
+
+	if len(unparseable) == 0 {
+		return
+	}
+	// The smallest value, so the warning does not change from run to run. ""
+	// is a value too, so it cannot mark that none was picked yet.
+	example, picked := "", false
+	for raw := range unparseable {
+		if !picked || raw < example {
+			example, picked = raw, true
+		}
+	}
+	errreport.To(w).Warnf(stage, "", "%s %d distinct end_time values are not valid timestamps, e.g. %q; a non-passed result was taken as the latest wherever they were compared",
+		mark.Warn, len(unparseable), example)
+	unparseable = make(map[string]bool)
+}
@@ -0,0 +1,100 @@
+package resultorder
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLater(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Entry
+		want bool
+	}{
+		// b is later by its timestamp, though earlier in the input
+		{"ordered", Entry{"2024-03-01T12:00:00Z", "passed", 1}, Entry{"2024-03-01T12:00:01Z", "passed", 0}, true},
+		{"ordered reversed", Entry{"2024-03-01T12:00:01Z", "passed", 0}, Entry{"2024-03-01T12:00:00Z", "passed", 1}, false},
+		{"mixed time zones", Entry{"2024-03-01T12:00:00Z", "passed", 0}, Entry{"2024-03-01T13:30:00+02:00", "passed", 1}, false},
+		{"mixed time zones reversed", Entry{"2024-03-01T13:30:00+02:00", "passed", 1}, Entry{"2024-03-01T12:00:00Z", "passed", 0}, true},
+		{"fractional seconds", Entry{"2024-03-01T12:00:00.9Z", "passed", 1}, Entry{"2024-03-01T12:00:00.10Z", "passed", 0}, false},
+		{"fractional against whole seconds", Entry{"2024-03-01T12:00:00Z", "passed", 1}, Entry{"2024-03-01T12:00:00.5Z", "passed", 0}, true},
+		{"Qase format against RFC3339", Entry{"2024-03-01 12:00:00", "passed", 1}, Entry{"2024-03-01T12:00:01Z", "passed", 0}, true},
+		{"Unix seconds against RFC3339", Entry{"1709294400", "passed", 1}, Entry{"2024-03-01T12:00:01Z", "passed", 0}, true},
+
+		// Identical timestamps fall back to the tiebreak
+		{"equal, pass after failure", Entry{"2024-03-01T12:00:00Z", "failed", 0}, Entry{"2024-03-01T12:00:00Z", "passed", 1}, false},
+		{"equal, failure after pass", Entry{"2024-03-01T12:00:00Z", "passed", 1}, Entry{"2024-03-01T12:00:00Z", "failed", 0}, true},
+		{"equal, both passed", Entry{"2024-03-01T12:00:00Z", "passed", 0}, Entry{"2024-03-01T12:00:00Z", "passed", 1}, true},
+		{"equal in different zones", Entry{"2024-03-01T14:00:00+02:00", "passed", 1}, Entry{"2024-03-01T12:00:00Z", "passed", 0}, false},
+
+		// So do timestamps that cannot be compared
+		{"malformed, pass after failure", Entry{"yesterday", "failed", 0}, Entry{"2024-03-01T12:00:00Z", "passed", 1}, false},
+		{"malformed, failure after pass", Entry{"2024-03-01T12:00:00Z", "passed", 0}, Entry{"yesterday", "failed", 1}, true},
+		{"both malformed", Entry{"yesterday", "passed", 0}, Entry{"today", "passed", 1}, true},
+		{"empty", Entry{"", "passed", 1}, Entry{"2024-03-01T12:00:00Z", "passed", 0}, false},
+		{"both empty", Entry{"", "failed", 0}, Entry{"", "failed", 1}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Later(test.a, test.b, 0); got != test.want {
+				t.Errorf("Later(%+v, %+v) = %v, want %v", test.a, test.b, got, test.want)
+			}
+		})
+	}
+	WarnUnparseable(io.Discard, "test")
+}
+
+func TestWarnUnparseableOnce(t *testing.T) {
+	WarnUnparseable(io.Discard, "test") // Forget end times of other tests
+
+	valid := Entry{EndTime: "2024-03-01T12:00:00Z", Status: "passed"}
+	for i, raw := range []string{"yesterday", "", "yesterday", "today", "yesterday"} {
+		Later(valid, Entry{EndTime: raw, Status: "passed", Pos: i}, 0)
+	}
+
+	var out bytes.Buffer
+	WarnUnparseable(&out, "match")
+	// "" sorts first among the 3 distinct values
+	if !strings.Contains(out.String(), `3 distinct end_time values`) || !strings.Contains(out.String(), `e.g. ""`) {
+		t.Errorf("warning %q does not count 3 distinct values", out.String())
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != 1 {
+		t.Errorf("%d warning lines, want 1", lines)
+	}
+
+	out.Reset()
+	WarnUnparseable(&out, "match")
+	if out.Len() != 0 {
+		t.Errorf("second call warned again: %q", out.String())
+	}
+}
+
+func TestLaterWithinTolerance(t *testing.T) {
+	pass := Entry{EndTime: "2024-03-01T12:00:02Z", Status: "passed", Pos: 1}
+	fail := Entry{EndTime: "2024-03-01T12:00:01Z", Status: "failed", Pos: 0}
+
+	// Without tolerance the pass a second later is the latest result
+	if !Later(fail, pass, 0) || Later(pass, fail, 0) {
+		t.Error("without tolerance the later end_time should win")
+	}
+	// Within tolerance they are simultaneous and the failure wins either way
+	for _, tolerance := range []time.Duration{time.Second, 2 * time.Second} {
+		if Later(fail, pass, tolerance) || !Later(pass, fail, tolerance) {
+			t.Errorf("tolerance %v: the failure should win over a pass within the window", tolerance)
+		}
+	}
+	// Outside the window the timestamps decide again
+	if !Later(fail, pass, 500*time.Millisecond) {
+		t.Error("tolerance 500ms: the later pass should win outside the window")
+	}
+
+	// Between two results of the same kind the later position wins
+	first := Entry{EndTime: "2024-03-01T12:00:02Z", Status: "failed", Pos: 0}
+	second := Entry{EndTime: "2024-03-01T12:00:01Z", Status: "failed", Pos: 1}
+	if !Later(first, second, 2*time.Second) || Later(second, first, 2*time.Second) {
+		t.Error("within tolerance the later position should win between two failures")
+	}
+}
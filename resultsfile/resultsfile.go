@@ -0,0 +1,138 @@
+package resultsfile
+
+import (
+	"bufio"
+	"bytes"
+	"complete_run/stdio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Result is one test result of a results file, as fetched from the API
+type Result struct {
+	Attachments []interface{} `json:"attachments"`
+	CaseID      int           `json:"case_id"`
+	Comment     *string       `json:"comment"`
+	EndTime     string        `json:"end_time"`
+	Hash        string        `json:"hash"`
+	IsAPIResult bool          `json:"is_api_result"`
+	RunID       int           `json:"run_id"`
+	StackTrace  *string       `json:"stacktrace"`
+	Status      string        `json:"status"`
+	Steps       *interface{}  `json:"steps"`
+	TimeSpentMS int           `json:"time_spent_ms"`
+}
+
+// Open opens a results file for reading, or stdin for "-". Gzip content is
+// decompressed transparently, including files made of several concatenated
+// gzip members as written by fetch with --compress-output. It is recognized by
+// the gzip magic bytes rather than the .gz extension, so a mislabeled file or
+// compressed stdin is still read correctly.
+func Open(name string) (io.ReadCloser, error) {
+	file, err := stdio.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	buffered := bufio.NewReader(file)
+	if magic, _ := buffered.Peek(2); !bytes.Equal(magic, gzipMagic) {
+		return &bufferedFile{Reader: buffered, file: file}, nil
+	}
+
+	zr, err := gzip.NewReader(buffered)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return &gzipFile{Reader: zr, file: file}, nil
+}
+
+// The first two bytes of every gzip member
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// bufferedFile reads through the buffer used to sniff the content and closes
+// the underlying file
+type bufferedFile struct {
+	*bufio.Reader
+	file io.Closer
+}
+
+func (f *bufferedFile) Close() error {
+	return f.file.Close()
+}
+
+// gzipFile closes both the decompressor and the underlying file
+type gzipFile struct {
+	*gzip.Reader
+	file io.Closer
+}
+
+func (f *gzipFile) Close() error {
+	err := f.Reader.Close()
+	if ferr := f.file.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// Each calls fn with every result in the file name. Results are read one per
+// line (NDJSON, as written by fetch), or as the elements of a single JSON
+// array when the content starts with '[', e.g. a results export from another
+// tool. The slice passed to fn is only valid until fn returns.
+func Each(name string, fn func(result []byte)) error {
+	file, err := Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	if isArray(reader) {
+		return eachArrayElement(reader, fn)
+	}
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		fn(scanner.Bytes())
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// isArray reports whether the first non-space byte of reader is '[', leaving
+// it unread
+func isArray(reader *bufio.Reader) bool {
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return false
+		}
+		if b == ' ' || b == '\t' || b == '\r' || b == '\n' {
+			continue
+		}
+		reader.UnreadByte()
+		return b == '['
+	}
+}
+
+func eachArrayElement(reader io.Reader, fn func(result []byte)) error {
+	decoder := json.NewDecoder(reader)
+	if _, err := decoder.Token(); err != nil { // The opening [
+		return fmt.Errorf("decoding results array: %v", err)
+	}
+	for decoder.More() {
+		var element json.RawMessage
+		if err := decoder.Decode(&element); err != nil {
+			return fmt.Errorf("decoding results array: %v", err)
+		}
+		fn(bytes.TrimSpace(element))
+	}
+	if _, err := decoder.Token(); err != nil { // The closing ]
+		return fmt.Errorf("decoding results array: %v", err)
+	}
+	return nil
+}
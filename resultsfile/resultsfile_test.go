@@ -0,0 +1,88 @@
+package resultsfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+const (
+	ndjson = `{"run_id":1,"case_id":1}
+{"run_id":1,"case_id":2}
+{"run_id":2,"case_id":1}
+`
+	array = `
+  [
+    {"run_id": 1, "case_id": 1},
+    {"run_id": 1, "case_id": 2},
+    {"run_id": 2, "case_id": 1}
+  ]
+`
+)
+
+// writeResults writes content to a file in a temporary directory, gzipped if
+// compress is set, and returns its path
+func writeResults(t *testing.T, content string, compress bool) string {
+	t.Helper()
+	data := []byte(content)
+	if compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(data)
+		zw.Close()
+		data = buf.Bytes()
+	}
+	path := filepath.Join(t.TempDir(), "results.json")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEach(t *testing.T) {
+	want := []string{`{"run_id":1,"case_id":1}`, `{"run_id":1,"case_id":2}`, `{"run_id":2,"case_id":1}`}
+	spaced := []string{`{"run_id": 1, "case_id": 1}`, `{"run_id": 1, "case_id": 2}`, `{"run_id": 2, "case_id": 1}`}
+	tests := []struct {
+		name     string
+		content  string
+		compress bool
+		want     []string
+	}{
+		{"NDJSON", ndjson, false, want},
+		{"gzipped NDJSON", ndjson, true, want},
+		{"JSON array", array, false, spaced},
+		{"gzipped JSON array", array, true, spaced},
+		{"compact JSON array", `[{"run_id":1,"case_id":1},{"run_id":1,"case_id":2},{"run_id":2,"case_id":1}]`, false, want},
+		{"empty JSON array", "[]\n", false, nil},
+		{"empty file", "", false, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			err := Each(writeResults(t, test.content, test.compress), func(result []byte) {
+				got = append(got, string(result))
+			})
+			if err != nil {
+				t.Fatalf("Each failed: %v", err)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEachRejectsMalformedArrays(t *testing.T) {
+	for _, content := range []string{
+		`[{"run_id":1}`,
+		`[{"run_id":1},]`,
+		`[{"run_id":1} {"run_id":2}]`,
+	} {
+		if err := Each(writeResults(t, content, false), func([]byte) {}); err == nil {
+			t.Errorf("Each(%q) succeeded, want an error", content)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package retry
+
+import (
+	"complete_run/clock"
+	"complete_run/config"
+	"complete_run/errreport"
+	"complete_run/mark"
+	"complete_run/transport"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config holds configuration for retry mechanism
+type Config struct {
+	MaxRetries     int
+	InitialDelay   time.Duration
+	MaxDelay       time.Duration
+	BackoffFactor  float64
+	RequestTimeout time.Duration
+}
+
+// Reads is the retry configuration of idempotent reads that are safe to retry.
+// MaxRetries is set from --read-retries by Configure.
+var Reads = Config{
+	MaxRetries:     3,
+	InitialDelay:   500 * time.Millisecond,
+	MaxDelay:       10 * time.Second,
+	BackoffFactor:  2.0,
+	RequestTimeout: 30 * time.Second,
+}
+
+// Configure sets the retry budget, the Retry-After ceiling and the retries of
+// reads from cfg. Call it before any request is made.
+func Configure(cfg *config.Config) {
+	setBudget(cfg.RetryBudget, cfg.RetryBudgetTime)
+	maxRetryAfter = cfg.MaxRetryAfter
+	Reads.MaxRetries = cfg.ReadRetries
+}
+
+// budget bounds the retries and backoff time spent across every request of a
+// single invocation, so a degraded API cannot keep the job sleeping for hours.
+// A zero limit means unlimited.
+type budget struct {
+	mu         sync.Mutex
+	maxRetries int
+	maxBackoff time.Duration
+	retries    int
+	backoff    time.Duration
+	exhausted  bool
+	reported   bool
+}
+
+// ErrBudgetExhausted is wrapped by the error of a request that was not retried
+// because the budget was spent
+var ErrBudgetExhausted = errors.New("retry budget exhausted")
+
+// Shared retry budget for all requests made through Do
+var shared = &budget{}
+
+// setBudget resets the shared budget with the given limits
+func setBudget(maxRetries int, maxBackoff time.Duration) {
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+	shared.maxRetries = maxRetries
+	shared.maxBackoff = maxBackoff
+	shared.retries = 0
+	shared.backoff = 0
+	shared.exhausted = false
+	shared.reported = false
+}
+
+// take reserves one retry sleeping for delay, returning false once the budget
+// is spent. The request that spends it says so on log.
+func (b *budget) take(delay time.Duration, log io.Writer) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.exhausted {
+		return false
+	}
+	if (b.maxRetries > 0 && b.retries >= b.maxRetries) ||
+		(b.maxBackoff > 0 && b.backoff+delay > b.maxBackoff) {
+		b.exhausted = true
+		fmt.Fprintln(log, "Retry budget exhausted, further failures will not be retried")
+		return false
+	}
+	b.retries++
+	b.backoff += delay
+	return true
+}
+
+// ReportBudget records a warning for stage, logged to w, when the budget ran
+// out during the run. The warning is only recorded by the first stage to
+// report it.
+func ReportBudget(w io.Writer, stage string) {
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+	if shared.exhausted && !shared.reported {
+		shared.reported = true
+		errreport.To(w).Warnf(stage, "", "%s Retry budget exhausted (%d retries, %v backoff); later failures were not retried", mark.Warn,
+			shared.retries, shared.backoff)
+	}
+}
+
+// Clock used for backoff sleeps; swappable for deterministic timing
+var clk = clock.Real
+
+// isRetryableError determines if an error should be retried
+func isRetryableError(err error, statusCode int) bool {
+	if err != nil {
+		// Network errors, timeouts, etc. are retryable
+		return true
+	}
+
+	// HTTP status codes that are retryable
+	switch statusCode {
+	case 429: // Too Many Requests
+		return true
+	case 500, 502, 503, 504: // Server errors
+		return true
+	default:
+		return false
+	}
+}
+
+// calculateBackoffDelay calculates the delay for exponential backoff
+func calculateBackoffDelay(attempt int, config Config) time.Duration {
+	delay := time.Duration(float64(config.InitialDelay) * math.Pow(config.BackoffFactor, float64(attempt)))
+	if delay > config.MaxDelay {
+		delay = config.MaxDelay
+	}
+	return delay
+}
+
+// Absolute ceiling on a server-requested Retry-After wait on HTTP 503.
+// Overridable via --max-retry-after.
+var maxRetryAfter = 5 * time.Minute
+
+// parseRetryAfter parses a Retry-After header in either its delay-seconds or
+// HTTP-date form
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// opKey is the request context key of a correlation ID
+type opKey struct{}
+
+// WithOp tags req with a correlation ID such as "run=123". Retry logging
+// prefixes it to every line, so one operation can be grepped out of
+// interleaved concurrent output.
+func WithOp(req *http.Request, op string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), opKey{}, op))
+}
+
+// logKey is the request context key of the writer retry lines go to
+type logKey struct{}
+
+// WithLog sends the retry lines of req to w instead of stdout
+func WithLog(req *http.Request, w io.Writer) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), logKey{}, w))
+}
+
+// logWriter returns where the retry lines of req go
+func logWriter(req *http.Request) io.Writer {
+	if w, ok := req.Context().Value(logKey{}).(io.Writer); ok {
+		return w
+	}
+	return os.Stdout
+}
+
+// LogPrefix returns "[op] " for a tagged request, with the attempt number
+// added when attempt > 0
+func LogPrefix(req *http.Request, attempt, attempts int) string {
+	op, _ := req.Context().Value(opKey{}).(string)
+	if attempt > 0 {
+		op = strings.TrimSpace(fmt.Sprintf("%s attempt=%d/%d", op, attempt, attempts))
+	}
+	if op == "" {
+		return ""
+	}
+	return "[" + op + "] "
+}
+
+// Do performs an HTTP request through client with retry logic. It also
+// returns how many attempts were made. Once ctx is done no further attempt is
+// made and a pending backoff is cut short; an attempt already sent finishes.
+func Do(ctx context.Context, client transport.HTTPDoer, req *http.Request, config Config) (*http.Response, int, error) {
+	var lastErr error
+	var resp *http.Response
+
+	for attempt := 0; attempt <= config.MaxRetries; attempt++ {
+		if attempt > 0 && ctx.Err() != nil {
+			return nil, attempt, fmt.Errorf("not retried (%v) after %d attempts: %v", ctx.Err(), attempt, lastErr)
+		}
+
+		// The previous attempt consumed the request body
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, attempt, fmt.Errorf("rewinding request body: %v", err)
+			}
+			req.Body = body
+		}
+
+		// Use the HTTP client's timeout instead of context timeout to avoid conflicts
+		resp, lastErr = client.Do(req)
+		serverDelay, serverRequested, maintenance := time.Duration(0), false, false
+
+		if lastErr == nil && resp != nil {
+			// Check if the status code indicates success or non-retryable error
+			statusErr := transport.CheckStatus(resp)
+			if statusErr == nil {
+				return resp, attempt + 1, nil
+			}
+
+			if !isRetryableError(nil, resp.StatusCode) {
+				return resp, attempt + 1, fmt.Errorf("request rejected: %w", statusErr)
+			}
+			lastErr = fmt.Errorf("HTTP %d", resp.StatusCode)
+
+			// When throttling us or during planned maintenance the server says
+			// how long to stay away
+			if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+				serverDelay, serverRequested = parseRetryAfter(resp.Header.Get("Retry-After"), clk.Now())
+				maintenance = resp.StatusCode == http.StatusServiceUnavailable
+			}
+
+			// Close the response body for retryable errors
+			resp.Body.Close()
+		}
+
+		// Don't sleep after the last attempt
+		if attempt < config.MaxRetries {
+			// A server-requested wait replaces the backoff. Throttling waits are
+			// capped at MaxDelay like the backoff itself; a 503 during planned
+			// maintenance may ask for longer, up to maxRetryAfter.
+			delay := calculateBackoffDelay(attempt, config)
+			switch {
+			case serverRequested && maintenance:
+				delay = min(serverDelay, maxRetryAfter)
+			case serverRequested:
+				delay = min(serverDelay, config.MaxDelay)
+			}
+			log := logWriter(req)
+			if !shared.take(delay, log) {
+				return nil, attempt + 1, fmt.Errorf("%w after %d attempts: %v", ErrBudgetExhausted, attempt+1, lastErr)
+			}
+			prefix := LogPrefix(req, attempt+1, config.MaxRetries+1)
+			if serverRequested {
+				fmt.Fprintf(log, "%s%s: server requested a wait of %v, waiting %v before retrying...\n",
+					prefix, lastErr, serverDelay, delay)
+			} else {
+				fmt.Fprintf(log, "%sRequest failed, retrying in %v...\n", prefix, delay)
+			}
+			select {
+			case <-clk.After(delay):
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	return resp, config.MaxRetries + 1, fmt.Errorf("request failed after %d attempts: %v", config.MaxRetries+1, lastErr)
+}
@@ -0,0 +1,364 @@
+package retry
+
+import (
+	"complete_run/clock"
+	"complete_run/transport"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+var testConfig = Config{
+	MaxRetries:    3,
+	InitialDelay:  500 * time.Millisecond,
+	MaxDelay:      10 * time.Second,
+	BackoffFactor: 2.0,
+}
+
+// useFakeClock swaps in a fake clock and an unlimited budget for one test
+func useFakeClock(t *testing.T) *clock.Fake {
+	t.Helper()
+	fake := clock.NewFake(start)
+	previous := clk
+	clk = fake
+	setBudget(0, 0)
+	t.Cleanup(func() {
+		clk = previous
+		setBudget(0, 0)
+	})
+	return fake
+}
+
+// statusServer answers the nth request with statuses[n], repeating the last
+// status once they run out. header is set on every response.
+func statusServer(t *testing.T, header http.Header, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1)) - 1
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(statuses[min(n, len(statuses)-1)])
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func get(t *testing.T, ctx context.Context, srv *httptest.Server, config Config) (*http.Response, int, error) {
+	t.Helper()
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, attempts, err := Do(ctx, srv.Client(), req, config)
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return resp, attempts, err
+}
+
+func TestIsRetryableError(t *testing.T) {
+	tests := []struct {
+		status int
+		err    error
+		want   bool
+	}{
+		{429, nil, true},
+		{500, nil, true},
+		{502, nil, true},
+		{503, nil, true},
+		{504, nil, true},
+		{400, nil, false},
+		{401, nil, false},
+		{404, nil, false},
+		{200, nil, false},
+		{0, errors.New("connection reset"), true},
+	}
+	for _, test := range tests {
+		if got := isRetryableError(test.err, test.status); got != test.want {
+			t.Errorf("isRetryableError(%v, %d) = %v, want %v", test.err, test.status, got, test.want)
+		}
+	}
+}
+
+func TestCalculateBackoffDelay(t *testing.T) {
+	want := []time.Duration{
+		500 * time.Millisecond,
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second, // 16s capped at MaxDelay
+		10 * time.Second,
+	}
+	for attempt, delay := range want {
+		if got := calculateBackoffDelay(attempt, testConfig); got != delay {
+			t.Errorf("attempt %d: delay %v, want %v", attempt, got, delay)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"3", 3 * time.Second, true},
+		{" 120 ", 2 * time.Minute, true},
+		{"0", 0, true},
+		{start.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{start.Add(-time.Minute).Format(http.TimeFormat), 0, true}, // A date in the past means now
+		{"", 0, false},
+		{"-5", 0, false},
+		{"soon", 0, false},
+	}
+	for _, test := range tests {
+		got, ok := parseRetryAfter(test.value, start)
+		if got != test.want || ok != test.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", test.value, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestDoBacksOffExponentially(t *testing.T) {
+	fake := useFakeClock(t)
+	srv, requests := statusServer(t, nil, 500, 502, 503, 200)
+
+	resp, attempts, err := get(t, context.Background(), srv, testConfig)
+	if err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+	if resp.StatusCode != 200 || attempts != 4 || requests.Load() != 4 {
+		t.Errorf("got status %d after %d attempts and %d requests, want 200 after 4", resp.StatusCode, attempts, requests.Load())
+	}
+	// 500ms + 1s + 2s of backoff
+	if waited := fake.Now().Sub(start); waited != 3500*time.Millisecond {
+		t.Errorf("waited %v, want 3.5s", waited)
+	}
+}
+
+func TestDoGivesUpAfterMaxRetries(t *testing.T) {
+	fake := useFakeClock(t)
+	srv, requests := statusServer(t, nil, 500)
+
+	_, attempts, err := get(t, context.Background(), srv, testConfig)
+	if err == nil {
+		t.Fatal("Do succeeded against a failing server")
+	}
+	if attempts != 4 || requests.Load() != 4 {
+		t.Errorf("%d attempts and %d requests, want 4", attempts, requests.Load())
+	}
+	// No sleep after the last attempt
+	if waited := fake.Now().Sub(start); waited != 3500*time.Millisecond {
+		t.Errorf("waited %v, want 3.5s", waited)
+	}
+}
+
+func TestDoHonorsRetryAfter(t *testing.T) {
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		fake := useFakeClock(t)
+		srv, _ := statusServer(t, http.Header{"Retry-After": {"3"}}, status, 200)
+
+		if _, _, err := get(t, context.Background(), srv, testConfig); err != nil {
+			t.Fatalf("HTTP %d: Do failed: %v", status, err)
+		}
+		if waited := fake.Now().Sub(start); waited != 3*time.Second {
+			t.Errorf("HTTP %d: waited %v, want the requested 3s instead of the 500ms backoff", status, waited)
+		}
+	}
+}
+
+func TestDoCapsRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header string
+		want   time.Duration
+	}{
+		{"seconds within MaxDelay", http.StatusTooManyRequests, "4", 4 * time.Second},
+		{"seconds beyond MaxDelay", http.StatusTooManyRequests, "600", 10 * time.Second},
+		{"HTTP date within MaxDelay", http.StatusTooManyRequests, start.Add(7 * time.Second).Format(http.TimeFormat), 7 * time.Second},
+		{"HTTP date beyond MaxDelay", http.StatusTooManyRequests, start.Add(time.Hour).Format(http.TimeFormat), 10 * time.Second},
+		{"unparseable falls back to the backoff", http.StatusTooManyRequests, "later", 500 * time.Millisecond},
+		{"empty falls back to the backoff", http.StatusTooManyRequests, "", 500 * time.Millisecond},
+		// Only throttling waits are capped at MaxDelay
+		{"maintenance beyond MaxDelay", http.StatusServiceUnavailable, "120", 2 * time.Minute},
+		{"unparseable maintenance wait falls back to the backoff", http.StatusServiceUnavailable, "later", 500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := useFakeClock(t)
+			srv, _ := statusServer(t, http.Header{"Retry-After": {test.header}}, test.status, 200)
+
+			if _, _, err := get(t, context.Background(), srv, testConfig); err != nil {
+				t.Fatalf("Do failed: %v", err)
+			}
+			if waited := fake.Now().Sub(start); waited != test.want {
+				t.Errorf("waited %v, want %v", waited, test.want)
+			}
+		})
+	}
+}
+
+func TestDoWaitsOutMaintenance(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		ceiling time.Duration // --max-retry-after
+		want    time.Duration
+	}{
+		{"long wait past MaxDelay", "120", 5 * time.Minute, 2 * time.Minute},
+		{"HTTP date past MaxDelay", start.Add(3 * time.Minute).Format(http.TimeFormat), 5 * time.Minute, 3 * time.Minute},
+		{"capped at the default ceiling", "3600", 5 * time.Minute, 5 * time.Minute},
+		{"capped at a lower ceiling", "120", time.Minute, time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := useFakeClock(t)
+			defer func(d time.Duration) { maxRetryAfter = d }(maxRetryAfter)
+			maxRetryAfter = test.ceiling
+			srv, requests := statusServer(t, http.Header{"Retry-After": {test.header}}, http.StatusServiceUnavailable, 200)
+
+			var log strings.Builder
+			req, err := http.NewRequest("GET", srv.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, _, err := Do(context.Background(), srv.Client(), WithLog(req, &log), testConfig)
+			if err != nil {
+				t.Fatalf("Do failed: %v", err)
+			}
+			resp.Body.Close()
+			if waited := fake.Now().Sub(start); waited != test.want || requests.Load() != 2 {
+				t.Errorf("retried once after %v and %d requests, want once after %v", waited, requests.Load(), test.want)
+			}
+			if want := fmt.Sprintf("waiting %v before retrying", test.want); !strings.Contains(log.String(), "server requested a wait") || !strings.Contains(log.String(), want) {
+				t.Errorf("log %q does not say it is waiting %v as the server requested", log.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestDoIgnoresRetryAfterOnOtherStatuses(t *testing.T) {
+	fake := useFakeClock(t)
+	srv, _ := statusServer(t, http.Header{"Retry-After": {"3"}}, 500, 200)
+
+	if _, _, err := get(t, context.Background(), srv, testConfig); err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+	if waited := fake.Now().Sub(start); waited != 500*time.Millisecond {
+		t.Errorf("waited %v, want the 500ms backoff", waited)
+	}
+}
+
+func TestDoDoesNotRetryClientErrors(t *testing.T) {
+	for _, status := range []int{400, 401, 403, 404, 422} {
+		useFakeClock(t)
+		srv, requests := statusServer(t, nil, status)
+
+		resp, attempts, err := get(t, context.Background(), srv, testConfig)
+		if err == nil {
+			t.Fatalf("HTTP %d: Do succeeded", status)
+		}
+		if attempts != 1 || requests.Load() != 1 {
+			t.Errorf("HTTP %d: %d attempts and %d requests, want 1", status, attempts, requests.Load())
+		}
+		if resp == nil || resp.StatusCode != status {
+			t.Errorf("HTTP %d: the rejected response was not returned", status)
+		}
+		unauthorized := status == 401 || status == 403
+		if errors.Is(err, transport.ErrUnauthorized) != unauthorized {
+			t.Errorf("HTTP %d: errors.Is(err, ErrUnauthorized) = %v", status, !unauthorized)
+		}
+	}
+}
+
+func TestDoStopsWhenContextIsCanceled(t *testing.T) {
+	useFakeClock(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		cancel() // The caller gives up while the first attempt is in flight
+		w.WriteHeader(500)
+	}))
+	defer srv.Close()
+
+	_, attempts, err := get(t, ctx, srv, testConfig)
+	if err == nil {
+		t.Fatal("Do succeeded")
+	}
+	if attempts != 1 || requests.Load() != 1 {
+		t.Errorf("%d attempts and %d requests after cancel, want 1", attempts, requests.Load())
+	}
+}
+
+func TestDoStopsWhenBudgetIsExhausted(t *testing.T) {
+	useFakeClock(t)
+	setBudget(2, 0)
+	srv, requests := statusServer(t, nil, 500)
+
+	_, attempts, err := get(t, context.Background(), srv, testConfig)
+	if !errors.Is(err, ErrBudgetExhausted) {
+		t.Fatalf("err = %v, want ErrBudgetExhausted", err)
+	}
+	if attempts != 3 || requests.Load() != 3 {
+		t.Errorf("%d attempts and %d requests, want 3: the first try and 2 budgeted retries", attempts, requests.Load())
+	}
+
+	// The budget is shared: the next request is not retried at all
+	_, attempts, err = get(t, context.Background(), srv, testConfig)
+	if !errors.Is(err, ErrBudgetExhausted) || attempts != 1 {
+		t.Errorf("second request: %d attempts, err %v; want 1 attempt and ErrBudgetExhausted", attempts, err)
+	}
+}
+
+func TestDoStopsWhenBackoffBudgetIsExhausted(t *testing.T) {
+	fake := useFakeClock(t)
+	setBudget(0, 1500*time.Millisecond)
+	srv, _ := statusServer(t, nil, 500)
+
+	_, attempts, err := get(t, context.Background(), srv, testConfig)
+	if !errors.Is(err, ErrBudgetExhausted) {
+		t.Fatalf("err = %v, want ErrBudgetExhausted", err)
+	}
+	// 500ms and 1s fit the budget; the 2s backoff would exceed it
+	if attempts != 3 || fake.Now().Sub(start) != 1500*time.Millisecond {
+		t.Errorf("%d attempts after %v, want 3 after 1.5s", attempts, fake.Now().Sub(start))
+	}
+}
+
+func TestDoResendsBody(t *testing.T) {
+	useFakeClock(t)
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 64)
+		n, _ := r.Body.Read(buf)
+		bodies = append(bodies, string(buf[:n]))
+		if len(bodies) == 1 {
+			w.WriteHeader(502)
+		}
+	}))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("POST", srv.URL, strings.NewReader(`{"a":1}`))
+	resp, _, err := Do(context.Background(), srv.Client(), req, testConfig)
+	if err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+	resp.Body.Close()
+	if len(bodies) != 2 || bodies[1] != `{"a":1}` {
+		t.Errorf("bodies sent: %q, want the body twice", bodies)
+	}
+}
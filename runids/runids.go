@@ -0,0 +1,185 @@
+package runids
+
+import (
+	"bytes"
+	"complete_run/mark"
+	"complete_run/stdio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Supported run ID file formats. Auto detects JSON arrays on read and writes CSV.
+const (
+	FormatAuto = "auto"
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+// Read loads run IDs from filename, or stdin for "-", in the given format.
+// Skipped entries are noted on log.
+func Read(filename, format string, log io.Writer) ([]int, error) {
+	content, err := stdio.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(content, format, log)
+}
+
+// Parse decodes run IDs from either a comma-separated list or a JSON array.
+// Empty entries, e.g. of an empty file or a trailing comma, are skipped. A
+// comma-separated entry that is not a positive integer is skipped with a note
+// on log rather than read as run ID 0; in a JSON array it is an error.
+func Parse(content []byte, format string, log io.Writer) ([]int, error) {
+	content = bytes.TrimSpace(content)
+
+	switch format {
+	case FormatAuto:
+		if len(content) > 0 && content[0] == '[' {
+			return parseJSON(content)
+		}
+		return parseCSV(content, log), nil
+	case FormatCSV:
+		return parseCSV(content, log), nil
+	case FormatJSON:
+		return parseJSON(content)
+	default:
+		return nil, fmt.Errorf("unknown run ID file format %q", format)
+	}
+}
+
+func parseCSV(content []byte, log io.Writer) []int {
+	var runIDs []int
+	var invalid []string
+	for _, part := range strings.Split(string(content), ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.Atoi(part)
+		if err != nil || id <= 0 {
+			invalid = append(invalid, strconv.Quote(part))
+			continue
+		}
+		runIDs = append(runIDs, id)
+	}
+	if len(invalid) > 0 {
+		fmt.Fprintf(log, "%s Skipping invalid run IDs (not positive integers): %s\n", mark.Warn, strings.Join(invalid, ", "))
+	}
+	return runIDs
+}
+
+func parseJSON(content []byte) ([]int, error) {
+	var runIDs []int
+	if err := json.Unmarshal(content, &runIDs); err != nil {
+		return nil, fmt.Errorf("parsing JSON run ID array: %v", err)
+	}
+	for _, id := range runIDs {
+		if id <= 0 {
+			return nil, fmt.Errorf("invalid run ID %d in JSON array (not a positive integer)", id)
+		}
+	}
+	return runIDs, nil
+}
+
+// Write stores run IDs in filename, or writes them to stdout for "-", in the
+// given format
+func Write(filename string, runIDs []int, format string) error {
+	content, err := Format(runIDs, format)
+	if err != nil {
+		return err
+	}
+	if filename == stdio.Name {
+		content = append(content, '\n')
+	}
+	return stdio.WriteFile(filename, content)
+}
+
+// Format encodes run IDs as a comma-separated list or a JSON array
+func Format(runIDs []int, format string) ([]byte, error) {
+	switch format {
+	case FormatAuto, FormatCSV:
+		parts := make([]string, len(runIDs))
+		for i, id := range runIDs {
+			parts[i] = strconv.Itoa(id)
+		}
+		return []byte(strings.Join(parts, ",")), nil
+	case FormatJSON:
+		if runIDs == nil {
+			runIDs = []int{}
+		}
+		return json.Marshal(runIDs)
+	default:
+		return nil, fmt.Errorf("unknown run ID file format %q", format)
+	}
+}
+
+// Diff returns the IDs in current but not in previous (added) and the IDs in
+// previous but not in current (removed), each sorted ascending
+func Diff(previous, current []int) (added, removed []int) {
+	inPrevious := make(map[int]bool, len(previous))
+	for _, id := range previous {
+		inPrevious[id] = true
+	}
+	inCurrent := make(map[int]bool, len(current))
+	for _, id := range current {
+		inCurrent[id] = true
+		if !inPrevious[id] {
+			added = append(added, id)
+		}
+	}
+	for id := range inPrevious {
+		if !inCurrent[id] {
+			removed = append(removed, id)
+		}
+	}
+	sort.Ints(added)
+	sort.Ints(removed)
+	return added, removed
+}
+
+// Meta records which project a run ID file was produced for. It is stored in a
+// sidecar file next to the run ID file so the run ID format stays untouched.
+type Meta struct {
+	ProjectCode string `json:"project_code"`
+}
+
+// MetaPath returns the sidecar path for a run ID file
+func MetaPath(filename string) string {
+	return filename + ".meta"
+}
+
+// WriteMeta stamps filename with the project code that produced it. Stdout
+// ("-") has no sidecar and is not stamped.
+func WriteMeta(filename, projectCode string) error {
+	if filename == stdio.Name {
+		return nil
+	}
+	data, err := json.Marshal(Meta{ProjectCode: projectCode})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(MetaPath(filename), data, 0644)
+}
+
+// ReadMeta reads the sidecar of filename. It returns os.ErrNotExist (wrapped)
+// when the file was not stamped, e.g. because another tool produced it or it
+// is stdin.
+func ReadMeta(filename string) (Meta, error) {
+	var meta Meta
+	if filename == stdio.Name {
+		return meta, os.ErrNotExist
+	}
+	data, err := os.ReadFile(MetaPath(filename))
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("parsing %s: %v", MetaPath(filename), err)
+	}
+	return meta, nil
+}
@@ -0,0 +1,89 @@
+package runids
+
+import (
+	"bytes"
+	"complete_run/mark"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		format  string
+		want    []int
+	}{
+		{"empty", "", FormatAuto, nil},
+		{"only whitespace", " \n\t", FormatAuto, nil},
+		{"only commas", ",,", FormatCSV, nil},
+		{"trailing comma", "12,34,", FormatAuto, []int{12, 34}},
+		{"trailing comma and newline", "12,34,\n", FormatCSV, []int{12, 34}},
+		{"empty entries and spaces", " 12 ,, 34 ", FormatAuto, []int{12, 34}},
+		{"JSON array", "[12, 34]\n", FormatAuto, []int{12, 34}},
+		{"empty JSON array", "[]", FormatJSON, []int{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Parse([]byte(test.content), test.format, io.Discard)
+			if err != nil {
+				t.Fatalf("Parse(%q) failed: %v", test.content, err)
+			}
+			if len(got) != len(test.want) || len(got) > 0 && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Parse(%q) = %v, want %v", test.content, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseSkipsGarbage(t *testing.T) {
+	mark.Plain()
+	tests := []struct {
+		content string
+		format  string
+		want    []int
+		note    string
+	}{
+		{"12,abc,34", FormatAuto, []int{12, 34}, `"abc"`},
+		{"12;34", FormatCSV, nil, `"12;34"`},
+		{"12,0", FormatCSV, []int{12}, `"0"`},
+		{"12,-3", FormatCSV, []int{12}, `"-3"`},
+		{"12,3.5", FormatCSV, []int{12}, `"3.5"`},
+		{"0x1F", FormatCSV, nil, `"0x1F"`},
+		{"abc, 12, x", FormatCSV, []int{12}, `"abc", "x"`},
+	}
+	for _, test := range tests {
+		var log bytes.Buffer
+		got, err := Parse([]byte(test.content), test.format, &log)
+		if err != nil {
+			t.Errorf("Parse(%q, %s) failed: %v", test.content, test.format, err)
+			continue
+		}
+		if len(got) != len(test.want) || len(got) > 0 && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Parse(%q, %s) = %v, want %v", test.content, test.format, got, test.want)
+		}
+		want := "WARN Skipping invalid run IDs (not positive integers): " + test.note + "\n"
+		if log.String() != want {
+			t.Errorf("Parse(%q, %s) logged %q, want %q", test.content, test.format, log.String(), want)
+		}
+	}
+}
+
+func TestParseRejectsGarbage(t *testing.T) {
+	tests := []struct {
+		content string
+		format  string
+	}{
+		{"[12,34", FormatAuto},
+		{`["12"]`, FormatJSON},
+		{"[12,0]", FormatJSON},
+		{"12,34", FormatJSON},
+		{"12,34", "tsv"},
+	}
+	for _, test := range tests {
+		if got, err := Parse([]byte(test.content), test.format, io.Discard); err == nil {
+			t.Errorf("Parse(%q, %s) = %v, want an error", test.content, test.format, got)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package setup
+
+import (
+	"complete_run/config"
+	"complete_run/curl"
+	"complete_run/endpoint"
+	"complete_run/redact"
+	"complete_run/retry"
+	"complete_run/transport"
+	"complete_run/verbose"
+	"sync"
+)
+
+var (
+	mu      sync.Mutex
+	applied *config.Config
+)
+
+// Apply sets up the process-wide request settings from cfg: the connection
+// limits and pacing of the shared transport, the retry budget and read
+// retries, the API endpoint, and redaction, curl and --verbose output. Every
+// stage entry point calls it, so a stage used as a library behaves as it does
+// on the command line. Calls with the config already applied do nothing, so
+// the stages of one pipeline share a single retry budget.
+func Apply(cfg *config.Config) {
+	mu.Lock()
+	defer mu.Unlock()
+	if cfg == applied {
+		return
+	}
+	applied = cfg
+
+	transport.SetMaxConnsPerHost(cfg.ConcurrencyPerHost)
+	transport.SetMinRequestInterval(cfg.MinRequestInterval)
+	retry.Configure(cfg)
+	endpoint.SetVersion(cfg.APIVersion)
+	if cfg.APIBaseURL != "" {
+		endpoint.SetBaseURL(cfg.APIBaseURL)
+	}
+
+	if cfg.Redact {
+		redact.Enable()
+	}
+	if cfg.PrintCurl {
+		curl.Enable()
+	}
+	if cfg.Verbose {
+		verbose.Enable()
+	}
+}
@@ -0,0 +1,58 @@
+package stdio
+
+import (
+	"io"
+	"os"
+)
+
+// Name is the path that means stdin when reading and stdout when writing
+const Name = "-"
+
+// Out is where output paths of "-" write. It is the process's real stdout even
+// after LogsToStderr.
+var Out io.Writer = os.Stdout
+
+// LogsToStderr moves the log lines, which are all printed to os.Stdout, to
+// stderr, so stdout carries nothing but data and can be piped into another
+// command. Call it before any output is written.
+func LogsToStderr() {
+	os.Stdout = os.Stderr
+}
+
+// Open opens name for reading, or stdin for "-"
+func Open(name string) (io.ReadCloser, error) {
+	if name == Name {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(name)
+}
+
+// ReadFile reads name, or all of stdin for "-"
+func ReadFile(name string) ([]byte, error) {
+	if name == Name {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(name)
+}
+
+// WriteFile writes data to name, or to Out for "-"
+func WriteFile(name string, data []byte) error {
+	if name == Name {
+		_, err := Out.Write(data)
+		return err
+	}
+	return os.WriteFile(name, data, 0644)
+}
+
+// Append opens name for appending, creating it if needed, or returns Out for
+// "-". Closing Out does nothing.
+func Append(name string) (io.WriteCloser, error) {
+	if name == Name {
+		return nopCloser{Out}, nil
+	}
+	return os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,173 @@
+package transport
+
+import (
+	"complete_run/clock"
+	"complete_run/mark"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Shared is the HTTP transport behind every stage's client, so connection
+// limits and idle-connection cleanup apply to the process as a whole.
+var Shared = http.DefaultTransport.(*http.Transport).Clone()
+
+// HTTPDoer sends an HTTP request. The stages send their API requests through
+// one, an *http.Client on Tracked by default, so a test can swap in an
+// httptest.Server client or a stub.
+type HTTPDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// CloseIdle closes the idle keep-alive connections of client, if it keeps any
+func CloseIdle(client HTTPDoer) {
+	if c, ok := client.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// ErrUnauthorized is wrapped by the error of a request the API refused with
+// 401 or 403. Retrying or moving on to the next run cannot fix a bad token, so
+// stages abort on it instead of treating the run or page as empty.
+var ErrUnauthorized = errors.New("API token rejected (check QASE_API_TOKEN)")
+
+// CheckStatus returns nil for a 2xx response. Otherwise the error names the
+// status, wrapping ErrUnauthorized for 401 and 403.
+func CheckStatus(resp *http.Response) error {
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("HTTP %d: %w", resp.StatusCode, ErrUnauthorized)
+	default:
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+}
+
+// Tracked wraps Shared and counts responses, so the end of the invocation can
+// report how often the API throttled us. Clients use it instead of Shared.
+var Tracked = &trackingTransport{}
+
+// SetMaxConnsPerHost bounds the simultaneous connections to each host,
+// api.qase.io included, regardless of how many goroutines are issuing
+// requests. Requests beyond the limit wait for a free connection. Zero means
+// unlimited. Call it before any request is made.
+func SetMaxConnsPerHost(n int) {
+	Shared.MaxConnsPerHost = n
+}
+
+// SetMinRequestInterval makes every request start at least d after the
+// previous one, across all stages and goroutines. It is a floor under the
+// per-stage rates: they can make requests rarer, never more frequent. Zero
+// means no minimum. Call it before any request is made.
+func SetMinRequestInterval(d time.Duration) {
+	Tracked.interval = d
+}
+
+// UseLimits records the request rate and concurrency a stage sends its
+// requests with. ReportThrottling suggests values below the highest recorded.
+func UseLimits(rps, concurrency int) {
+	Tracked.mu.Lock()
+	defer Tracked.mu.Unlock()
+	Tracked.rps = max(Tracked.rps, rps)
+	Tracked.concurrency = max(Tracked.concurrency, concurrency)
+}
+
+// Clock used for spacing requests; swappable for deterministic timing
+var clk = clock.Real
+
+type trackingTransport struct {
+	responses atomic.Int64
+	throttled atomic.Int64
+
+	interval time.Duration // Minimum gap between request starts
+	mu       sync.Mutex    // Guards next, rps and concurrency
+	next     time.Time     // Earliest start of the next request
+
+	rps         int // Highest stage request rate, see UseLimits
+	concurrency int // Highest stage concurrency, see UseLimits
+}
+
+// pace waits for the next free request slot when a minimum interval is set.
+// Slots are handed out in call order, so concurrent callers queue up.
+func (t *trackingTransport) pace() {
+	if t.interval <= 0 {
+		return
+	}
+	t.mu.Lock()
+	now := clk.Now()
+	start := t.next
+	if start.Before(now) {
+		start = now
+	}
+	t.next = start.Add(t.interval)
+	t.mu.Unlock()
+
+	clk.Sleep(start.Sub(now))
+}
+
+func (t *trackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.pace()
+	resp, err := Shared.RoundTrip(req)
+	if err == nil {
+		t.responses.Add(1)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			t.throttled.Add(1)
+		}
+	}
+	return resp, err
+}
+
+// CloseIdleConnections lets http.Client.CloseIdleConnections reach Shared
+func (t *trackingTransport) CloseIdleConnections() {
+	Shared.CloseIdleConnections()
+}
+
+// ReportThrottling prints a warning to w with a lower --rps and --concurrency
+// to try when more than maxRatio of all responses were HTTP 429. It never
+// fails the run.
+func ReportThrottling(w io.Writer, maxRatio float64) {
+	Tracked.mu.Lock()
+	rps, concurrency := Tracked.rps, Tracked.concurrency
+	Tracked.mu.Unlock()
+	Tracked.report(w, maxRatio, rps, concurrency)
+}
+
+func (t *trackingTransport) report(w io.Writer, maxRatio float64, rps, concurrency int) {
+	responses := t.responses.Load()
+	throttled := t.throttled.Load()
+	if responses == 0 || maxRatio <= 0 {
+		return
+	}
+	ratio := float64(throttled) / float64(responses)
+	if ratio <= maxRatio {
+		return
+	}
+
+	fmt.Fprintf(w, "%s %d of %d API responses (%.1f%%) were HTTP 429; the API is throttling this job.", mark.Warn,
+		throttled, responses, ratio*100)
+	var flags []string
+	if rps > 1 {
+		flags = append(flags, fmt.Sprintf("--rps %d", lowered(rps, ratio)))
+	}
+	if concurrency > 1 {
+		flags = append(flags, fmt.Sprintf("--concurrency %d", lowered(concurrency, ratio)))
+	}
+	if len(flags) > 0 {
+		fmt.Fprintf(w, " Consider lowering the request rate, e.g. %s (now %d per second, %d in flight)",
+			strings.Join(flags, " "), rps, concurrency)
+	}
+	fmt.Fprintln(w)
+}
+
+// lowered scales a limit down to the share of requests that were not
+// throttled, and by at least one
+func lowered(limit int, throttledRatio float64) int {
+	scaled := int(float64(limit) * (1 - throttledRatio))
+	return max(min(scaled, limit-1), 1)
+}
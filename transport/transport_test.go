@@ -0,0 +1,71 @@
+package transport
+
+import (
+	"bytes"
+	"complete_run/clock"
+	"complete_run/mark"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPaceSpacesRequests(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	defer func(c clock.Clock) { clk = c }(clk)
+	clk = fake
+
+	tracker := &trackingTransport{interval: 100 * time.Millisecond}
+	var starts []time.Duration
+	for i := 0; i < 4; i++ {
+		tracker.pace()
+		starts = append(starts, fake.Now().Sub(start))
+	}
+	for i, want := range []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond} {
+		if starts[i] != want {
+			t.Errorf("request %d started at %v, want %v", i, starts[i], want)
+		}
+	}
+
+	// A request after a long pause starts at once
+	fake.Advance(time.Second)
+	before := fake.Now()
+	tracker.pace()
+	if waited := fake.Now().Sub(before); waited != 0 {
+		t.Errorf("request after a pause waited %v", waited)
+	}
+}
+
+func TestReportThrottlingSuggestsLowerLimits(t *testing.T) {
+	mark.Plain()
+	tests := []struct {
+		name             string
+		throttled        int64
+		rps, concurrency int
+		want             string
+	}{
+		{"below the ratio", 5, 6, 6, ""},
+		{"scaled by the ratio", 30, 6, 6, "30 of 100 API responses (30.0%) were HTTP 429; the API is throttling this job. " +
+			"Consider lowering the request rate, e.g. --rps 4 --concurrency 4 (now 6 per second, 6 in flight)\n"},
+		{"lowered by at least one", 6, 20, 5, "e.g. --rps 18 --concurrency 4 (now 20 per second, 5 in flight)\n"},
+		{"one at a time", 50, 5, 1, "e.g. --rps 2 (now 5 per second, 1 in flight)\n"},
+		{"nothing left to lower", 90, 1, 1, "the API is throttling this job.\n"},
+	}
+	for _, test := range tests {
+		tracker := &trackingTransport{}
+		tracker.responses.Store(100)
+		tracker.throttled.Store(test.throttled)
+
+		var out bytes.Buffer
+		tracker.report(&out, 0.05, test.rps, test.concurrency)
+		if test.want == "" {
+			if out.Len() > 0 {
+				t.Errorf("%s: warned %q", test.name, out.String())
+			}
+			continue
+		}
+		if !strings.HasSuffix(out.String(), test.want) {
+			t.Errorf("%s: warned %q, want it to end in %q", test.name, out.String(), test.want)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package verbose
+
+import (
+	"fmt"
+	"io"
+)
+
+var enabled bool
+
+// Enable turns on the debug output: raw API responses, file contents and full
+// run ID lists. Without it only per-run outcomes and summaries are printed.
+func Enable() {
+	enabled = true
+}
+
+// Enabled reports whether debug output is on
+func Enabled() bool {
+	return enabled
+}
+
+// Fprintf prints to w like fmt.Fprintf, but only with --verbose
+func Fprintf(w io.Writer, format string, args ...interface{}) {
+	if enabled {
+		fmt.Fprintf(w, format, args...)
+	}
+}
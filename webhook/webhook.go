@@ -0,0 +1,90 @@
+package webhook
+
+import (
+	"bytes"
+	"complete_run/clock"
+	"complete_run/redact"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	runURL string
+	client *http.Client
+	slots  chan struct{} // Bounds the callbacks in flight
+	wg     sync.WaitGroup
+	clk    = clock.Real
+)
+
+// runEvent is the payload POSTed after each completion attempt
+type runEvent struct {
+	RunID     int    `json:"run_id"`
+	Success   bool   `json:"success"`
+	Timestamp string `json:"timestamp"`
+}
+
+// EnableRunCallbacks turns on a POST to url after every completion attempt.
+// At most concurrency callbacks are in flight and each gives up after timeout.
+func EnableRunCallbacks(url string, concurrency int, timeout time.Duration) {
+	runURL = url
+	client = &http.Client{Timeout: timeout}
+	slots = make(chan struct{}, max(concurrency, 1))
+}
+
+// RunCompleted reports a completion attempt to the per-run webhook, if one is
+// enabled. It never blocks the caller: when every slot is busy the callback is
+// dropped, and failures are only logged to log, so a slow or flaky consumer
+// cannot stall the sweep.
+func RunCompleted(log io.Writer, runID int, success bool) {
+	if runURL == "" {
+		return
+	}
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		fmt.Fprintf(log, "Per-run webhook busy, dropped callback for run %s\n", redact.ID(runID))
+		return
+	}
+
+	event := runEvent{RunID: runID, Success: success, Timestamp: clk.Now().UTC().Format(time.RFC3339)}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() { <-slots }()
+		if err := post(client, runURL, event); err != nil {
+			fmt.Fprintf(log, "Per-run webhook failed for run %s: %v\n", redact.ID(runID), err)
+		}
+	}()
+}
+
+// Wait blocks until the callbacks in flight have finished or timed out
+func Wait() {
+	wg.Wait()
+}
+
+// SendSummary POSTs summary as JSON to url once, giving up after timeout. It
+// is sent at exit, so unlike the per-run callbacks it waits for the answer.
+func SendSummary(url string, timeout time.Duration, summary interface{}) error {
+	return post(&http.Client{Timeout: timeout}, url, summary)
+}
+
+func post(client *http.Client, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}